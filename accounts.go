@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// accountConfig is the configuration of one Xfinity account. Empty fields fall back to the global
+// options, except for the ones that must be unique to the account.
+type accountConfig struct {
+	// Name identifies the account in logs, alerts and the account label of the metrics. It is
+	// empty for the implicit account of a single account config.
+	Name             string
+	ClientSecret     string
+	RefreshToken     string
+	TokenStore       string
+	KubernetesSecret string
+	// MQTTTopicPrefix replaces the state, attributes, history and availability topics with
+	// <prefix>/state, <prefix>/attributes, <prefix>/history and <prefix>/availability.
+	MQTTTopicPrefix string
+	HistoryFile     string
+	AlertStateFile  string
+
+	// Files the secrets are read from, see secretFile.
+	ClientSecretFile string
+	RefreshTokenFile string
+}
+
+var accountNameRE = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// fields maps the config file keys of an account to its fields.
+func (a *accountConfig) fields() map[string]*string {
+	return map[string]*string{
+		"name":               &a.Name,
+		"client_secret":      &a.ClientSecret,
+		"client_secret_file": &a.ClientSecretFile,
+		"refresh_token":      &a.RefreshToken,
+		"refresh_token_file": &a.RefreshTokenFile,
+		"token_store":        &a.TokenStore,
+		"kubernetes_secret":  &a.KubernetesSecret,
+		"mqtt_topic_prefix":  &a.MQTTTopicPrefix,
+		"history_file":       &a.HistoryFile,
+		"alert_state_file":   &a.AlertStateFile,
+	}
+}
+
+// parseAccounts converts the accounts list of the config file. YAML decodes it as a list of maps
+// and TOML, as an array of tables.
+func parseAccounts(v any) ([]accountConfig, error) {
+	var tables []map[string]any
+	switch v := v.(type) {
+	case []map[string]any:
+		tables = v
+	case []any:
+		for i, e := range v {
+			m, ok := e.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("accounts[%d]: expected a table", i)
+			}
+			tables = append(tables, m)
+		}
+	default:
+		return nil, fmt.Errorf("accounts: expected a list of tables")
+	}
+
+	accounts := make([]accountConfig, len(tables))
+	for i, m := range tables {
+		fields := accounts[i].fields()
+		for k, v := range m {
+			f, ok := fields[k]
+			if !ok {
+				return nil, fmt.Errorf("accounts[%d]: unknown key %q", i, k)
+			}
+			s, err := configValue(v)
+			if err != nil {
+				return nil, fmt.Errorf("accounts[%d].%s: %w", i, k, err)
+			}
+			*f = s
+		}
+	}
+	return accounts, nil
+}
+
+// registerAccountSecretFiles reads the secrets of the accounts from files like the global ones.
+// accounts must not be reallocated afterwards.
+func registerAccountSecretFiles(accounts []accountConfig) {
+	for i := range accounts {
+		a := &accounts[i]
+		key := fmt.Sprintf("accounts[%s].", a.Name)
+		for _, s := range []*secretFile{
+			{key: key + "client_secret", fileKey: key + "client_secret_file", path: a.ClientSecretFile, dest: &a.ClientSecret},
+			{key: key + "refresh_token", fileKey: key + "refresh_token_file", path: a.RefreshTokenFile, dest: &a.RefreshToken},
+		} {
+			if s.path != "" {
+				secretFiles = append(secretFiles, s)
+			}
+		}
+	}
+}
+
+// accountList returns the configured accounts with the global options filled in, or the implicit
+// account made of the global options if none are configured.
+func (c config) accountList() []accountConfig {
+	if len(c.accounts) == 0 {
+		return []accountConfig{{
+			ClientSecret:     c.clientSecret,
+			RefreshToken:     c.refreshToken,
+			TokenStore:       c.tokenStore,
+			KubernetesSecret: c.kubernetesSecret,
+			HistoryFile:      c.historyPath,
+			AlertStateFile:   c.alertStateFile,
+		}}
+	}
+	out := make([]accountConfig, len(c.accounts))
+	for i, a := range c.accounts {
+		if a.ClientSecret == "" {
+			a.ClientSecret = c.clientSecret
+		}
+		out[i] = a
+	}
+	return out
+}
+
+// selectAccounts returns the account with the given name, or every account if name is empty.
+func (c config) selectAccounts(name string) ([]accountConfig, error) {
+	accounts := c.accountList()
+	if name == "" {
+		return accounts, nil
+	}
+	for _, a := range accounts {
+		if a.Name == name {
+			return []accountConfig{a}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown account %q", name)
+}
+
+// findAccount returns the account with the given name, which can be omitted if there is a single
+// account.
+func (c config) findAccount(name string) (accountConfig, error) {
+	accounts, err := c.selectAccounts(name)
+	if err != nil {
+		return accountConfig{}, err
+	}
+	if len(accounts) > 1 {
+		return accountConfig{}, fmt.Errorf("--account is required with several accounts")
+	}
+	return accounts[0], nil
+}
+
+// validateAccounts reports the problems of the configured accounts.
+func (c config) validateAccounts() []error {
+	var errs []error
+	if len(c.accounts) > 0 && (c.refreshToken != "" || c.accessToken != "" || c.tokenStore != "") {
+		errs = append(errs, fmt.Errorf("--refresh_token, --access_token and --token_store can't be combined with accounts"))
+	}
+	// These are per account, so the global ones would otherwise be silently ignored.
+	if len(c.accounts) > 0 && (c.kubernetesSecret != "" || c.historyPath != "" || c.alertStateFile != "") {
+		errs = append(errs, fmt.Errorf("--kubernetes_secret, --history_file and --alert_state_file can't be combined with accounts, set them per account"))
+	}
+	if c.accountConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("--account_concurrency must be positive"))
+	}
+	seen := map[string]bool{}
+	prefixes := map[string]bool{}
+	for i, a := range c.accountList() {
+		if len(c.accounts) == 0 {
+			break
+		}
+		if !accountNameRE.MatchString(a.Name) {
+			errs = append(errs, fmt.Errorf("accounts[%d]: invalid name %q, expected lower case letters, digits, _ and -", i, a.Name))
+		} else if seen[a.Name] {
+			errs = append(errs, fmt.Errorf("accounts[%d]: duplicate name %q", i, a.Name))
+		}
+		seen[a.Name] = true
+		if a.ClientSecret == "" {
+			errs = append(errs, fmt.Errorf("accounts[%s]: missing client_secret", a.Name))
+		}
+		if a.RefreshToken == "" && a.TokenStore == "" {
+			errs = append(errs, fmt.Errorf("accounts[%s]: either refresh_token or token_store must be provided", a.Name))
+		}
+		if !c.sinkEnabled(sinkMQTT) {
+			continue
+		}
+		if a.MQTTTopicPrefix == "" {
+			errs = append(errs, fmt.Errorf("accounts[%s]: missing mqtt_topic_prefix", a.Name))
+		} else if prefixes[a.MQTTTopicPrefix] {
+			errs = append(errs, fmt.Errorf("accounts[%s]: duplicate mqtt_topic_prefix %q", a.Name, a.MQTTTopicPrefix))
+		}
+		prefixes[a.MQTTTopicPrefix] = true
+	}
+	return errs
+}
+
+// runAccounts runs fn for every app, at most --account_concurrency at a time. A failing account
+// doesn't stop the others, the errors are joined.
+func runAccounts(ctx context.Context, apps []*app, fn func(context.Context, *app) error) error {
+	sem := make(chan struct{}, max(cfg.accountConcurrency, 1))
+	errs := make([]error, len(apps))
+	var wg sync.WaitGroup
+	for i, a := range apps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = a.wrap(ctx.Err())
+				return
+			}
+			defer func() { <-sem }()
+			if err := fn(ctx, a); err != nil {
+				errs[i] = a.wrap(err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateAccountsTopicPrefix(t *testing.T) {
+	accounts := []accountConfig{
+		{Name: "home", ClientSecret: "secret", RefreshToken: "token", MQTTTopicPrefix: "xfinity"},
+		{Name: "cabin", ClientSecret: "secret", RefreshToken: "token", MQTTTopicPrefix: "xfinity"},
+		{Name: "office", ClientSecret: "secret", RefreshToken: "token"},
+	}
+	tests := []struct {
+		sinks   string
+		wantErr []string
+	}{
+		{sinks: "mqtt", wantErr: []string{`accounts[cabin]: duplicate mqtt_topic_prefix "xfinity"`, "accounts[office]: missing mqtt_topic_prefix"}},
+		{sinks: "influxdb,homeassistant"},
+		{sinks: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sinks, func(t *testing.T) {
+			c := config{accounts: accounts, accountConcurrency: 1, sinkList: tt.sinks}
+			err := errors.Join(c.validateAccounts()...)
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Errorf("validateAccounts() = %v, want no errors", err)
+			}
+			for _, want := range tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("validateAccounts() = %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
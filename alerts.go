@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/google/logger"
+)
+
+// alertMetric is the value an alert rule compares to the allowance.
+type alertMetric string
+
+const (
+	// alertMetricUsage is the current usage.
+	alertMetricUsage alertMetric = "usage"
+	// alertMetricEstimated is the estimated usage at the end of the cycle.
+	alertMetricEstimated alertMetric = "estimated"
+)
+
+// alertRule fires when the metric reaches percent of the allowance.
+type alertRule struct {
+	metric  alertMetric
+	percent int
+}
+
+func (r alertRule) String() string {
+	return fmt.Sprintf("%s:%d", r.metric, r.percent)
+}
+
+// parseAlertRules parses a comma separated list of <usage|estimated>:<percent> rules.
+func parseAlertRules(s string) ([]alertRule, error) {
+	var rules []alertRule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		metric, percent, ok := strings.Cut(part, ":")
+		p, err := strconv.Atoi(percent)
+		if !ok || err != nil || p <= 0 {
+			return nil, fmt.Errorf("invalid alert rule %q, expected <usage|estimated>:<percent>", part)
+		}
+		switch m := alertMetric(metric); m {
+		case alertMetricUsage, alertMetricEstimated:
+			rules = append(rules, alertRule{metric: m, percent: p})
+		default:
+			return nil, fmt.Errorf("invalid alert rule %q, unknown metric %q", part, metric)
+		}
+	}
+	return rules, nil
+}
+
+// alert is a notification for a rule that fired.
+type alert struct {
+	Account string `json:"account,omitempty"`
+	Rule    string `json:"rule"`
+	Title   string `json:"title"`
+	Message string `json:"message"`
+	// Attributes are the usage attributes at the time the alert fired.
+	Attributes *UsageAttributes `json:"attributes"`
+}
+
+// alertState is the set of rules that already fired in the current billing cycle.
+type alertState struct {
+	Cycle string   `json:"cycle"`
+	Fired []string `json:"fired"`
+}
+
+// alerter evaluates the alert rules on every fetch and sends each alert to every notifier once per
+// billing cycle. The rules that fired are persisted to statePath, if set, so they aren't sent again
+// after a restart.
+type alerter struct {
+	account   string
+	rules     []alertRule
+	notifiers []notifier
+	statePath string
+
+	state alertState
+}
+
+// newAlerter returns the alerter for the given rules, or nil if alerting is disabled.
+func newAlerter(account string, rules []alertRule, notifiers []notifier, statePath string) (*alerter, error) {
+	if len(rules) == 0 || len(notifiers) == 0 {
+		return nil, nil
+	}
+	a := &alerter{account: account, rules: rules, notifiers: notifiers, statePath: statePath}
+	if statePath == "" {
+		return a, nil
+	}
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alert state: %w", err)
+	}
+	if err := json.Unmarshal(data, &a.state); err != nil {
+		return nil, fmt.Errorf("failed to parse alert state %s: %w", statePath, err)
+	}
+	return a, nil
+}
+
+// evaluate sends the alerts of the rules that started firing. When several rules of the same
+// metric fire at once, e.g. on the first run, only the highest one is sent. Failing to notify is
+// logged but doesn't fail the run; the alert is sent again on the next run unless at least one
+// notifier succeeded.
+func (a *alerter) evaluate(ctx context.Context, attributes *UsageAttributes, currentGB float32) {
+	if attributes.AllowableUsage == nil || *attributes.AllowableUsage <= 0 {
+		return
+	}
+	if a.state.Cycle != attributes.StartDate {
+		a.state = alertState{Cycle: attributes.StartDate}
+	}
+
+	allowable := float32(*attributes.AllowableUsage)
+	values := map[alertMetric]float32{alertMetricUsage: currentGB, alertMetricEstimated: attributes.UsageEstimated}
+	highest := map[alertMetric]alertRule{}
+	firing := map[alertMetric][]string{}
+	for _, r := range a.rules {
+		if values[r.metric] < allowable*float32(r.percent)/100 || slices.Contains(a.state.Fired, r.String()) {
+			continue
+		}
+		firing[r.metric] = append(firing[r.metric], r.String())
+		if h, ok := highest[r.metric]; !ok || r.percent > h.percent {
+			highest[r.metric] = r
+		}
+	}
+
+	fired := false
+	for _, metric := range []alertMetric{alertMetricUsage, alertMetricEstimated} {
+		r, ok := highest[metric]
+		if !ok {
+			continue
+		}
+		al := newAlert(a.account, r, attributes, currentGB)
+		log.Infof("alerts: %s", al.Title)
+		sent := false
+		for _, n := range a.notifiers {
+			if err := n.notify(ctx, al); err != nil {
+				recordError(errorCategoryAlertNotify, a.account)
+				log.Errorf("alerts: failed to notify %s: %v", n.name(), err)
+				continue
+			}
+			alertsSentTotal.WithLabelValues(a.account, n.name()).Inc()
+			sent = true
+		}
+		if sent {
+			a.state.Fired = append(a.state.Fired, firing[metric]...)
+			fired = true
+		}
+	}
+	if !fired {
+		return
+	}
+	if err := a.save(); err != nil {
+		recordError(errorCategoryAlertState, a.account)
+		log.Errorf("alerts: %v", err)
+	}
+}
+
+func (a *alerter) save() error {
+	if a.statePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(a.state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert state: %w", err)
+	}
+	if err := writeFileAtomic(a.statePath, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write alert state: %w", err)
+	}
+	return nil
+}
+
+func newAlert(account string, r alertRule, attributes *UsageAttributes, currentGB float32) alert {
+	allowable := *attributes.AllowableUsage
+	al := alert{Account: account, Rule: r.String(), Attributes: attributes}
+	switch r.metric {
+	case alertMetricUsage:
+		al.Title = fmt.Sprintf("Xfinity usage reached %d%% of the allowance", r.percent)
+		al.Message = fmt.Sprintf("Used %.0f GB of %d GB with %d days remaining, projected %.0f GB by the end of the cycle.",
+			currentGB, allowable, attributes.DaysRemaining, attributes.UsageEstimated)
+	case alertMetricEstimated:
+		al.Title = fmt.Sprintf("Xfinity usage projected to reach %d%% of the allowance", r.percent)
+		al.Message = fmt.Sprintf("Projected %.0f GB of %d GB by the end of the cycle, used %.0f GB so far with %d days remaining.",
+			attributes.UsageEstimated, allowable, currentGB, attributes.DaysRemaining)
+		if attributes.ProjectedCapDate != "" {
+			al.Message += fmt.Sprintf(" The allowance is projected to be exceeded on %s.", attributes.ProjectedCapDate)
+		}
+	}
+	if attributes.OverageProjectedCost != nil && *attributes.OverageProjectedCost > 0 {
+		al.Message += fmt.Sprintf(" Projected overage cost: $%d.", *attributes.OverageProjectedCost)
+	}
+	if account != "" {
+		al.Title += " (" + account + ")"
+	}
+	return al
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// recordingNotifier records the rules of the alerts it was sent.
+type recordingNotifier struct {
+	rules []string
+}
+
+func (n *recordingNotifier) name() string {
+	return "recording"
+}
+
+func (n *recordingNotifier) notify(_ context.Context, al alert) error {
+	n.rules = append(n.rules, al.Rule)
+	return nil
+}
+
+func TestAlerterFiresOncePerCycle(t *testing.T) {
+	rules, err := parseAlertRules("usage:80,usage:90,usage:100,estimated:100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statePath := filepath.Join(t.TempDir(), "alerts.json")
+	allowable := 1000
+	attributes := func(cycle string, estimated float32) *UsageAttributes {
+		return &UsageAttributes{StartDate: cycle, AllowableUsage: &allowable, UsageEstimated: estimated}
+	}
+
+	steps := []struct {
+		name string
+		// restart creates a new alerter from the state file before the step.
+		restart    bool
+		attributes *UsageAttributes
+		currentGB  float32
+		want       []string
+	}{
+		{name: "below thresholds", attributes: attributes("2026-10-01", 700), currentGB: 500},
+		{name: "highest usage rule and estimate", attributes: attributes("2026-10-01", 1100), currentGB: 910, want: []string{"usage:90", "estimated:100"}},
+		{name: "already fired", attributes: attributes("2026-10-01", 1100), currentGB: 950},
+		{name: "already fired after restart", restart: true, attributes: attributes("2026-10-01", 1100), currentGB: 960},
+		{name: "next rule after restart", restart: true, attributes: attributes("2026-10-01", 1150), currentGB: 1000, want: []string{"usage:100"}},
+		{name: "new cycle", restart: true, attributes: attributes("2026-11-01", 1200), currentGB: 850, want: []string{"usage:80", "estimated:100"}},
+		{name: "new cycle already fired", attributes: attributes("2026-11-01", 1200), currentGB: 870},
+	}
+	n := &recordingNotifier{}
+	a, err := newAlerter("", rules, []notifier{n}, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range steps {
+		if s.restart {
+			if a, err = newAlerter("", rules, []notifier{n}, statePath); err != nil {
+				t.Fatalf("%s: newAlerter() = %v", s.name, err)
+			}
+		}
+		n.rules = nil
+		a.evaluate(context.Background(), s.attributes, s.currentGB)
+		if !slices.Equal(n.rules, s.want) {
+			t.Errorf("%s: sent %q, want %q", s.name, n.rules, s.want)
+		}
+	}
+}
+
+func TestAlerterWithoutAllowance(t *testing.T) {
+	rules, err := parseAlertRules("usage:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &recordingNotifier{}
+	a, err := newAlerter("", rules, []notifier{n}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.evaluate(context.Background(), &UsageAttributes{StartDate: "2026-10-01", UsageEstimated: 5000}, 5000)
+	if len(n.rules) != 0 {
+		t.Errorf("sent %q for an unlimited plan, want nothing", n.rules)
+	}
+}
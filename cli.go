@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+
+	log "github.com/google/logger"
+)
+
+// command is a subcommand of the CLI. Every command accepts the global flags, before or after its
+// name, in addition to its own.
+type command struct {
+	// name is the command and its subcommand, if any, e.g. "token show".
+	name    string
+	args    string
+	summary string
+	help    string
+	// flags defines the flags specific to the command.
+	flags func(fs *flag.FlagSet)
+	// run is called with the positional arguments once the flags and the config are loaded.
+	run func(ctx context.Context, args []string) error
+	// output is set for commands that print their result, which only log errors so the output
+	// can be piped.
+	output bool
+	// noConfig skips loading the config file and the secret files.
+	noConfig bool
+}
+
+// newCommands returns the commands of the CLI, the first one being the default.
+func newCommands() []*command {
+	return []*command{
+		fetchCommand(),
+		tokenRefreshCommand(),
+		tokenShowCommand(),
+		queryCommand(),
+		monthsCommand(),
+		versionCommand(),
+	}
+}
+
+// runCLI runs the command selected by args and returns the exit code.
+func runCLI(args []string) int {
+	commands := newCommands()
+	flag.Usage = func() { printUsage(flag.CommandLine.Output(), commands) }
+	flag.CommandLine.Parse(args)
+	args = flag.Args()
+
+	if len(args) > 0 && args[0] == "help" {
+		if len(args) == 1 {
+			printUsage(os.Stdout, commands)
+			return 0
+		}
+		c, _, err := findCommand(commands, args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		own, _ := c.flagSet()
+		own.SetOutput(os.Stdout)
+		own.Usage()
+		return 0
+	}
+
+	c := commands[0]
+	if len(args) > 0 {
+		var err error
+		if c, args, err = findCommand(commands, args); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\nRun '%s -h' for usage.\n", err, os.Args[0])
+			return 2
+		}
+	}
+	_, fs := c.flagSet()
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if c.args == "" && fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "%s: unexpected arguments %q\n", c.name, fs.Args())
+		fs.Usage()
+		return 2
+	}
+
+	if !c.noConfig {
+		explicit := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+		fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+		if err := loadConfig(explicit); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	// Info logs go to stdout, so they are disabled when it carries the output.
+	quiet := c.output || cfg.outputFormat() != ""
+	log.Init("xfinity-usage", cfg.verbose > 0 && !quiet, false, io.Discard)
+	log.SetLevel(log.Level(cfg.verbose))
+	defer log.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := c.run(ctx, fs.Args()); err != nil {
+		log.Errorf("main: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// findCommand returns the command named by the first arguments and the remaining arguments.
+func findCommand(commands []*command, args []string) (*command, []string, error) {
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && slices.Equal(args[:len(words)], words) {
+			return c, args[len(words):], nil
+		}
+	}
+	var subcommands []string
+	for _, c := range commands {
+		if group, sub, ok := strings.Cut(c.name, " "); ok && group == args[0] {
+			subcommands = append(subcommands, sub)
+		}
+	}
+	if len(subcommands) > 0 {
+		return nil, nil, fmt.Errorf("%s: expected one of the subcommands %s", args[0], strings.Join(subcommands, ", "))
+	}
+	return nil, nil, fmt.Errorf("unknown command %q", args[0])
+}
+
+// flagSet returns the flag set with only the flags of the command, used for its help, and the one
+// that also has the global flags, used to parse its arguments.
+func (c *command) flagSet() (own, all *flag.FlagSet) {
+	own = flag.NewFlagSet(c.name, flag.ContinueOnError)
+	if c.flags != nil {
+		c.flags(own)
+	}
+	all = flag.NewFlagSet(c.name, flag.ContinueOnError)
+	own.VisitAll(func(f *flag.Flag) { all.Var(f.Value, f.Name, f.Usage) })
+	flag.VisitAll(func(f *flag.Flag) {
+		if all.Lookup(f.Name) == nil {
+			all.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	usage := func() { c.printUsage(own) }
+	own.Usage, all.Usage = usage, usage
+	return own, all
+}
+
+func (c *command) printUsage(own *flag.FlagSet) {
+	w := own.Output()
+	synopsis := c.name
+	hasFlags := false
+	own.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		synopsis += " [flags]"
+	}
+	if c.args != "" {
+		synopsis += " " + c.args
+	}
+	fmt.Fprintf(w, "Usage: %s [global flags] %s\n\n%s\n", os.Args[0], synopsis, c.summary)
+	if c.help != "" {
+		fmt.Fprintf(w, "\n%s\n", c.help)
+	}
+	if hasFlags {
+		fmt.Fprintf(w, "\nFlags:\n")
+		own.PrintDefaults()
+	}
+	fmt.Fprintf(w, "\nRun '%s -h' for the global flags.\n", os.Args[0])
+}
+
+func printUsage(w io.Writer, commands []*command) {
+	fmt.Fprintf(w, "Usage: %s [global flags] [command] [flags] [args]\n\n", os.Args[0])
+	fmt.Fprintf(w, "Fetches the Xfinity internet usage and publishes it to MQTT and Prometheus.\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-14s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "  %-14s %s\n", "help", "Show the help of a command")
+	fmt.Fprintf(w, "\nRun '%s help <command>' for the flags of a command. The global flags are accepted by\n", os.Args[0])
+	fmt.Fprintf(w, "every command, before or after its name.\n\nGlobal flags:\n")
+	flag.CommandLine.SetOutput(w)
+	flag.PrintDefaults()
+}
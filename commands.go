@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/csobrinho/xfinity-usage/xfinity"
+	log "github.com/google/logger"
+)
+
+func fetchCommand() *command {
+	return &command{
+		name:    "fetch",
+		summary: "Fetch the usage and publish it to MQTT and Prometheus (default)",
+		help: "Runs once, or as a daemon with --interval or --schedule. For compatibility, --query runs\n" +
+			"the query command instead.",
+		run: func(ctx context.Context, _ []string) error {
+			if cfg.query != "" {
+				log.Info("main: running test query")
+				return runQuery(ctx, "", cfg.query, "")
+			}
+			return runFetch(ctx)
+		},
+	}
+}
+
+func tokenRefreshCommand() *command {
+	var account string
+	var reveal bool
+	return &command{
+		name:    "token refresh",
+		summary: "Refresh the OAuth tokens and save them to the token store",
+		help: "The new tokens are saved to --token_store and the rotated refresh token to\n" +
+			"--kubernetes_secret, like a fetch does. If the refresh token is rotated and neither is\n" +
+			"set, it is printed in full so it isn't lost.",
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&account, "account", "", "Account to refresh, defaults to every account")
+			fs.BoolVar(&reveal, "reveal", false, "Print the tokens in full")
+		},
+		output: true,
+		run: func(ctx context.Context, _ []string) error {
+			if cfg.accessToken != "" {
+				return fmt.Errorf("a provided --access_token can't be refreshed")
+			}
+			return eachAccount(ctx, account, func(ctx context.Context, a accountConfig, _ *xfinity.Client, tokens *tokenManager) error {
+				before := tokens.state().RefreshToken
+				if err := tokens.refresh(); err != nil {
+					return err
+				}
+				t := tokens.state()
+				lost := t.RefreshToken != before && !tokens.persisted()
+				if lost {
+					fmt.Fprintln(os.Stderr, "The refresh token was rotated and isn't saved anywhere, keep the one printed below.")
+				}
+				return printTokens(os.Stdout, a, t, reveal || lost)
+			})
+		},
+	}
+}
+
+func tokenShowCommand() *command {
+	var account string
+	var reveal bool
+	return &command{
+		name:    "token show",
+		summary: "Show the current OAuth tokens and their expiry",
+		help:    "The tokens are read from --token_store, falling back to the configured ones, without refreshing them.",
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&account, "account", "", "Account to show, defaults to every account")
+			fs.BoolVar(&reveal, "reveal", false, "Print the tokens in full")
+		},
+		output: true,
+		run: func(ctx context.Context, _ []string) error {
+			return eachAccount(ctx, account, func(_ context.Context, a accountConfig, _ *xfinity.Client, tokens *tokenManager) error {
+				t := tokens.state()
+				if cfg.accessToken != "" {
+					t.AccessToken, t.IDToken, t.Expiry = cfg.accessToken, cfg.idToken, time.Time{}
+				}
+				return printTokens(os.Stdout, a, t, reveal)
+			})
+		},
+	}
+}
+
+func queryCommand() *command {
+	var account, variables string
+	return &command{
+		name:    "query",
+		args:    "[query]",
+		summary: "Run a raw GraphQL query and print the response",
+		help: "The query is either a GraphQL document or a complete JSON request body. It is read from the\n" +
+			"argument, from stdin if the argument is -, or from --query.",
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&account, "account", "", "Account to query, required with several accounts")
+			fs.StringVar(&variables, "variables", "", "JSON object with the query variables")
+		},
+		output: true,
+		run: func(ctx context.Context, args []string) error {
+			q := cfg.query
+			switch {
+			case len(args) > 1:
+				return fmt.Errorf("expected a single query argument")
+			case len(args) == 1 && args[0] == "-":
+				data, err := io.ReadAll(os.Stdin)
+				if err != nil {
+					return fmt.Errorf("failed to read query from stdin: %w", err)
+				}
+				q = string(data)
+			case len(args) == 1:
+				q = args[0]
+			}
+			if strings.TrimSpace(q) == "" {
+				return fmt.Errorf("missing query")
+			}
+			return runQuery(ctx, account, q, variables)
+		},
+	}
+}
+
+func monthsCommand() *command {
+	var account string
+	var asJSON bool
+	return &command{
+		name:    "months",
+		summary: "List the usage of every billing cycle returned by the API",
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&account, "account", "", "Account to list, required with several accounts")
+			fs.BoolVar(&asJSON, "json", false, "Print the months as JSON")
+		},
+		output: true,
+		run: func(ctx context.Context, _ []string) error {
+			a, err := cfg.findAccount(account)
+			if err != nil {
+				return err
+			}
+			return eachAccount(ctx, a.Name, func(ctx context.Context, _ accountConfig, api *xfinity.Client, tokens *tokenManager) error {
+				var u *xfinity.Usage
+				err := tokens.do(func() (err error) {
+					u, err = api.InternetDataUsage(ctx)
+					return err
+				})
+				if err != nil {
+					return fmt.Errorf("failed to get internet usage: %w", err)
+				}
+				months, err := monthlyUsage(u)
+				if err != nil {
+					return fmt.Errorf("failed to build usage history: %w", err)
+				}
+				if asJSON {
+					enc := json.NewEncoder(os.Stdout)
+					enc.SetIndent("", "  ")
+					return enc.Encode(newMonthsOutput(months))
+				}
+				return printMonths(os.Stdout, months)
+			})
+		},
+	}
+}
+
+func versionCommand() *command {
+	return &command{
+		name:     "version",
+		summary:  "Print the version and build information",
+		output:   true,
+		noConfig: true,
+		run: func(context.Context, []string) error {
+			fmt.Printf("xfinity-usage %s\n", version)
+			fmt.Printf("go:       %s\n", runtime.Version())
+			fmt.Printf("platform: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+			if info, ok := debug.ReadBuildInfo(); ok {
+				settings := map[string]string{}
+				for _, s := range info.Settings {
+					settings[s.Key] = s.Value
+				}
+				if rev := settings["vcs.revision"]; rev != "" {
+					if settings["vcs.modified"] == "true" {
+						rev += "-dirty"
+					}
+					fmt.Printf("commit:   %s\n", rev)
+				}
+				if t := settings["vcs.time"]; t != "" {
+					fmt.Printf("built:    %s\n", t)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// eachAccount calls fn with the API client and tokens of the account with the given name, or of
+// every account if name is empty, in order. A failing account doesn't stop the others.
+func eachAccount(ctx context.Context, name string, fn func(context.Context, accountConfig, *xfinity.Client, *tokenManager) error) error {
+	if err := validateAuthConfig(); err != nil {
+		return err
+	}
+	accounts, err := cfg.selectAccounts(name)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	var errs []error
+	for _, a := range accounts {
+		api, tokens, err := newAccountClient(ctx, a, newHTTPClient())
+		if err == nil {
+			err = fn(ctx, a, api, tokens)
+		}
+		if err != nil {
+			errs = append(errs, accountError(a.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runQuery runs a GraphQL query for one account and prints the response.
+func runQuery(ctx context.Context, account, q, variables string) error {
+	body, err := graphqlBody(q, variables)
+	if err != nil {
+		return err
+	}
+	a, err := cfg.findAccount(account)
+	if err != nil {
+		return err
+	}
+	return eachAccount(ctx, a.Name, func(ctx context.Context, _ accountConfig, api *xfinity.Client, tokens *tokenManager) error {
+		return actionRunQuery(ctx, api, tokens, body, os.Stdout)
+	})
+}
+
+// graphqlBody returns the request body of a query, which can also be a complete request, e.g.
+// {"query": "...", "variables": {...}}.
+func graphqlBody(q, variables string) (string, error) {
+	q = strings.TrimSpace(q)
+	if strings.HasPrefix(q, "{") && json.Valid([]byte(q)) {
+		if variables != "" {
+			return "", fmt.Errorf("--variables can't be combined with a complete request body")
+		}
+		return q, nil
+	}
+	req := map[string]any{"query": q}
+	if variables != "" {
+		var v map[string]any
+		if err := json.Unmarshal([]byte(variables), &v); err != nil {
+			return "", fmt.Errorf("invalid --variables: %w", err)
+		}
+		req["variables"] = v
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal query: %w", err)
+	}
+	return string(data), nil
+}
+
+// printTokens prints the tokens of an account, masked unless reveal is set.
+func printTokens(w io.Writer, a accountConfig, t storedToken, reveal bool) error {
+	show := func(s string) string {
+		switch {
+		case s == "":
+			return "none"
+		case reveal:
+			return s
+		case len(s) <= 12:
+			return "****"
+		default:
+			return s[:4] + "…" + s[len(s)-4:]
+		}
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if a.Name != "" {
+		fmt.Fprintf(tw, "account:\t%s\n", a.Name)
+	}
+	fmt.Fprintf(tw, "refresh token:\t%s\n", show(t.RefreshToken))
+	access := show(t.AccessToken)
+	switch {
+	case t.AccessToken == "" || t.Expiry.IsZero():
+	case time.Now().Before(t.Expiry):
+		access += fmt.Sprintf(", expires at %s (in %s)", t.Expiry.Format(time.RFC3339), time.Until(t.Expiry).Round(time.Second))
+	default:
+		access += fmt.Sprintf(", expired at %s", t.Expiry.Format(time.RFC3339))
+	}
+	fmt.Fprintf(tw, "access token:\t%s\n", access)
+	fmt.Fprintf(tw, "id token:\t%s\n", show(t.IDToken))
+	store := a.TokenStore
+	if store == "" {
+		store = "none"
+	}
+	fmt.Fprintf(tw, "token store:\t%s\n\n", store)
+	return tw.Flush()
+}
+
+// monthsOutput is the JSON output of the months command. The months that can't be parsed are
+// listed as returned by the API instead of being dropped.
+type monthsOutput struct {
+	Months   []UsageHistoryMonth    `json:"months"`
+	Unparsed []xfinity.UsageMonthly `json:"unparsed,omitempty"`
+}
+
+func newMonthsOutput(months []xfinity.UsageMonthly) monthsOutput {
+	out := monthsOutput{Months: []UsageHistoryMonth{}}
+	for _, m := range months {
+		if hm, err := newUsageHistoryMonth(m); err == nil {
+			out.Months = append(out.Months, hm)
+		} else {
+			out.Unparsed = append(out.Unparsed, m)
+		}
+	}
+	return out
+}
+
+// printMonths prints a table of the months. A month that can't be parsed is printed with the raw
+// values returned by the API and a ? for the month.
+func printMonths(w io.Writer, months []xfinity.UsageMonthly) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "MONTH\tSTART\tEND\tPOLICY\tUSAGE GB\tALLOWANCE GB\tOVERAGE\tCHARGE\t")
+	for _, raw := range months {
+		m, err := newUsageHistoryMonth(raw)
+		month, usage, allowance, charge := fmt.Sprintf("%04d-%02d", m.Year, m.Month), fmt.Sprintf("%.1f", m.Usage), "-", "-"
+		if err != nil {
+			log.Warningf("main: printing unparsed month: %v", err)
+			month, usage = "?", rawUsage(raw.CurrentUsage)
+			m = UsageHistoryMonth{StartDate: raw.StartDate, EndDate: raw.EndDate, Policy: raw.Policy, Overage: raw.Overage, OverageCharges: raw.OverageCharge}
+			if raw.Policy != xfinity.PolicyUnlimited {
+				allowance = rawUsage(raw.AllowableUsage)
+			}
+		}
+		if m.AllowableUsage != nil {
+			allowance = fmt.Sprint(*m.AllowableUsage)
+		}
+		if m.OverageCharges != nil {
+			charge = fmt.Sprintf("$%d", *m.OverageCharges)
+		}
+		overage := "no"
+		if m.Overage {
+			overage = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			month, m.StartDate, m.EndDate, m.Policy, usage, allowance, overage, charge)
+	}
+	return tw.Flush()
+}
+
+// rawUsage formats a usage value as returned by the API, e.g. "12 PB".
+func rawUsage(u xfinity.UsageValue) string {
+	if u.Value == nil {
+		return "-"
+	}
+	return strings.TrimSpace(fmt.Sprintf("%g %s", *u.Value, u.Unit))
+}
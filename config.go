@@ -1,62 +1,321 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 	"time"
 )
 
 type config struct {
-	timeout             time.Duration
-	verbose             int
-	clientID            string
-	clientSecret        string
-	refreshToken        string
-	accessToken         string
-	idToken             string
-	applicationID       string
-	mqttURL             string
-	mqttClientID        string
-	mqttStateTopic      string
-	mqttAttributesTopic string
-	mqttUsername        string
-	mqttPassword        string
-	prometheusEndpoint  string
-	prometheusJob       string
-	query               string
+	configFile                   string
+	timeout                      time.Duration
+	verbose                      int
+	clientID                     string
+	clientSecret                 string
+	refreshToken                 string
+	tokenStore                   string
+	tokenExpiryMargin            time.Duration
+	kubernetesSecret             string
+	kubernetesSecretKey          string
+	kubernetesNamespace          string
+	accessToken                  string
+	idToken                      string
+	applicationID                string
+	sinkList                     string
+	influxURL                    string
+	influxMeasurement            string
+	influxTags                   string
+	influxBucket                 string
+	influxOrg                    string
+	influxToken                  string
+	influxDatabase               string
+	influxRetentionPolicy        string
+	influxUsername               string
+	influxPassword               string
+	homeAssistantURL             string
+	homeAssistantToken           string
+	homeAssistantEntityID        string
+	homeAssistantHistoryEntityID string
+	mqttURL                      string
+	mqttClientID                 string
+	mqttStateTopic               string
+	mqttAttributesTopic          string
+	mqttHistoryTopic             string
+	mqttDiscovery                bool
+	mqttDiscoveryPrefix          string
+	mqttNodeID                   string
+	mqttAvailability             string
+	mqttUsername                 string
+	mqttPassword                 string
+	mqttCAFile                   string
+	mqttCertFile                 string
+	mqttKeyFile                  string
+	mqttServerName               string
+	mqttInsecure                 bool
+	prometheusEndpoint           string
+	prometheusJob                string
+	listenAddr                   string
+	readyMaxAge                  time.Duration
+	historyPath                  string
+	historyRetention             time.Duration
+	forecastModel                string
+	overageBlockGB               int
+	overageBlockPrice            int
+	overageMaxCharge             int
+	alertRules                   string
+	alertStateFile               string
+	alertWebhookURL              string
+	alertNtfyURL                 string
+	alertNtfyToken               string
+	alertGotifyURL               string
+	alertGotifyToken             string
+	alertSlackURL                string
+	alertSMTPAddr                string
+	alertSMTPUsername            string
+	alertSMTPPassword            string
+	alertSMTPFrom                string
+	alertSMTPTo                  string
+	accounts                     []accountConfig
+	accountConcurrency           int
+	query                        string
+	dryRun                       bool
+	output                       string
+	interval                     time.Duration
+	schedule                     string
+	jitter                       time.Duration
+	retryBackoff                 time.Duration
 }
 
 var cfg config
 
+// mqtt returns the MQTT publisher settings.
+func (c config) mqtt() mqttConfig {
+	m := mqttConfig{
+		url:             c.mqttURL,
+		username:        c.mqttUsername,
+		password:        c.mqttPassword,
+		clientID:        c.mqttClientID,
+		stateTopic:      c.mqttStateTopic,
+		attributesTopic: c.mqttAttributesTopic,
+		historyTopic:    c.mqttHistoryTopic,
+
+		caFile:             c.mqttCAFile,
+		certFile:           c.mqttCertFile,
+		keyFile:            c.mqttKeyFile,
+		serverName:         c.mqttServerName,
+		insecureSkipVerify: c.mqttInsecure,
+
+		availabilityTopic: c.mqttAvailability,
+		daemon:            c.daemon(),
+	}
+	if c.mqttDiscovery {
+		m.discoveryPrefix = c.mqttDiscoveryPrefix
+		m.nodeID = c.mqttNodeID
+	}
+	return m
+}
+
+// mqttFor returns the MQTT publisher settings of an account, which uses its own connection and,
+// if it has a topic prefix, its own topics and discovery node.
+func (c config) mqttFor(a accountConfig) mqttConfig {
+	m := c.mqtt()
+	if a.Name == "" {
+		return m
+	}
+	m.account = a.Name
+	m.clientID += "-" + a.Name
+	if m.nodeID != "" {
+		m.nodeID += "_" + a.Name
+	}
+	if p := a.MQTTTopicPrefix; p != "" {
+		m.stateTopic = p + "/state"
+		m.attributesTopic = p + "/attributes"
+		if m.historyTopic != "" {
+			m.historyTopic = p + "/history"
+		}
+		if m.availabilityTopic != "" {
+			m.availabilityTopic = p + "/availability"
+		}
+	}
+	return m
+}
+
+// overage returns the overage cost model.
+func (c config) overage() overageCostModel {
+	return overageCostModel{blockGB: c.overageBlockGB, blockPrice: c.overageBlockPrice, maxCharge: c.overageMaxCharge}
+}
+
+// notifiers returns the configured alert notifiers.
+func (c config) notifiers(client *http.Client) []notifier {
+	var out []notifier
+	if c.alertWebhookURL != "" {
+		out = append(out, newWebhookNotifier(client, c.alertWebhookURL))
+	}
+	if c.alertNtfyURL != "" {
+		out = append(out, newNtfyNotifier(client, c.alertNtfyURL, c.alertNtfyToken))
+	}
+	if c.alertGotifyURL != "" {
+		out = append(out, newGotifyNotifier(client, c.alertGotifyURL, c.alertGotifyToken))
+	}
+	if c.alertSlackURL != "" {
+		out = append(out, newSlackNotifier(client, c.alertSlackURL))
+	}
+	if c.alertSMTPAddr != "" {
+		var to []string
+		for _, addr := range strings.Split(c.alertSMTPTo, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				to = append(to, addr)
+			}
+		}
+		out = append(out, newSMTPNotifier(c.alertSMTPAddr, c.alertSMTPUsername, c.alertSMTPPassword, c.alertSMTPFrom, to))
+	}
+	return out
+}
+
+// daemon reports whether the process should keep running on a schedule instead of exiting after one run.
+func (c config) daemon() bool {
+	return c.interval > 0 || c.schedule != ""
+}
+
+// outputFormat returns the format a dry run prints the messages in, or "" to publish them.
+func (c config) outputFormat() string {
+	if c.output != "" {
+		return c.output
+	}
+	if c.dryRun {
+		return outputTable
+	}
+	return ""
+}
+
+// validate reports every problem with the config at once.
 func (c config) validate() error {
-	if c.clientID == "" {
-		return fmt.Errorf("missing --client_id")
+	errs := c.validateAuth()
+	errs = append(errs, c.validateSinks()...)
+	if c.sinkEnabled(sinkMQTT) {
+		errs = append(errs, c.validateMQTT()...)
 	}
-	if c.refreshToken == "" && c.accessToken == "" {
-		return fmt.Errorf("either --refresh_token or --access_token must be provided")
+	// A dry run only prints the MQTT messages, so the other sinks aren't needed.
+	if c.sinkEnabled(sinkInfluxDB) && c.outputFormat() == "" {
+		errs = append(errs, c.validateInflux()...)
 	}
-	if c.accessToken != "" && c.idToken == "" {
-		return fmt.Errorf("if --access_token is provided, --id_token must also be provided")
+	if c.sinkEnabled(sinkHomeAssistant) && c.outputFormat() == "" {
+		errs = append(errs, c.validateHomeAssistant()...)
+	}
+	switch c.output {
+	case "", outputJSON, outputTable, outputYAML:
+	default:
+		errs = append(errs, fmt.Errorf("unsupported --output %q, expected json, table or yaml", c.output))
+	}
+	if c.interval < 0 {
+		errs = append(errs, fmt.Errorf("--interval must not be negative"))
+	}
+	if c.interval > 0 && c.schedule != "" {
+		errs = append(errs, fmt.Errorf("only one of --interval or --schedule can be provided"))
+	}
+	if c.schedule != "" {
+		if _, err := newSchedule(c.schedule, 0); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.jitter < 0 || c.retryBackoff < 0 {
+		errs = append(errs, fmt.Errorf("--jitter and --retry_backoff must not be negative"))
+	}
+	if c.readyMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("--ready_max_age must not be negative"))
 	}
-	if c.accessToken == "" && c.clientSecret == "" {
-		return fmt.Errorf("missing --client_secret")
+	if c.historyRetention < 0 {
+		errs = append(errs, fmt.Errorf("--history_retention must not be negative"))
 	}
-	if c.mqttURL == "" {
-		return fmt.Errorf("missing --mqtt_url")
+	if model, err := parseForecastModel(c.forecastModel); err != nil {
+		errs = append(errs, err)
+	} else if model == forecastEWMA || model == forecastSeasonal {
+		// These models learn from the daily totals of the snapshots, which only the history has.
+		for _, a := range c.accountList() {
+			if a.HistoryFile == "" {
+				errs = append(errs, accountError(a.Name, fmt.Errorf("--forecast_model=%s requires --history_file", model)))
+			}
+		}
+	}
+	if c.overageBlockGB <= 0 {
+		errs = append(errs, fmt.Errorf("--overage_block_gb must be positive"))
+	}
+	if c.overageBlockPrice < 0 || c.overageMaxCharge < 0 {
+		errs = append(errs, fmt.Errorf("--overage_block_price and --overage_max_charge must not be negative"))
+	}
+	if rules, err := parseAlertRules(c.alertRules); err != nil {
+		errs = append(errs, err)
+	} else if len(rules) > 0 && len(c.notifiers(nil)) > 0 && !c.daemon() && c.outputFormat() == "" {
+		// One-shot runs would otherwise send the same alerts again on every run.
+		for _, a := range c.accountList() {
+			if a.AlertStateFile == "" {
+				errs = append(errs, accountError(a.Name, fmt.Errorf("alerts outside daemon mode require --alert_state_file")))
+			}
+		}
+	}
+	if c.alertGotifyURL != "" && c.alertGotifyToken == "" {
+		errs = append(errs, fmt.Errorf("--alert_gotify_url requires --alert_gotify_token"))
+	}
+	if c.alertSMTPAddr != "" && (c.alertSMTPFrom == "" || strings.TrimSpace(c.alertSMTPTo) == "") {
+		errs = append(errs, fmt.Errorf("--alert_smtp_addr requires --alert_smtp_from and --alert_smtp_to"))
+	}
+	return errors.Join(errs...)
+}
+
+// validateMQTT reports the problems with the MQTT sink settings.
+func (c config) validateMQTT() []error {
+	var errs []error
+	// A dry run only prints the messages, so it doesn't need a broker.
+	if c.mqttURL == "" && c.outputFormat() == "" {
+		errs = append(errs, fmt.Errorf("missing --mqtt_url"))
 	}
 	if c.mqttClientID == "" {
-		return fmt.Errorf("missing --mqtt_client_id")
+		errs = append(errs, fmt.Errorf("missing --mqtt_client_id"))
 	}
 	if c.mqttStateTopic == "" {
-		return fmt.Errorf("missing --mqtt_state_topic")
+		errs = append(errs, fmt.Errorf("missing --mqtt_state_topic"))
 	}
 	if c.mqttAttributesTopic == "" {
-		return fmt.Errorf("missing --mqtt_attributes_topic")
+		errs = append(errs, fmt.Errorf("missing --mqtt_attributes_topic"))
+	}
+	if c.mqttUsername == "" && c.outputFormat() == "" {
+		errs = append(errs, fmt.Errorf("missing --mqtt_username"))
+	}
+	if c.mqttPassword == "" && c.outputFormat() == "" {
+		errs = append(errs, fmt.Errorf("missing --mqtt_password"))
+	}
+	if (c.mqttCertFile == "") != (c.mqttKeyFile == "") {
+		errs = append(errs, fmt.Errorf("--mqtt_cert_file and --mqtt_key_file must be provided together"))
+	}
+	if c.mqttDiscovery && (c.mqttDiscoveryPrefix == "" || c.mqttNodeID == "") {
+		errs = append(errs, fmt.Errorf("--mqtt_discovery requires --mqtt_discovery_prefix and --mqtt_node_id"))
+	}
+	return errs
+}
+
+// validateAuth reports the problems with the options needed to call the API, which is all the
+// commands other than fetch need.
+func (c config) validateAuth() []error {
+	var errs []error
+	if c.clientID == "" {
+		errs = append(errs, fmt.Errorf("missing --client_id"))
+	}
+	if len(c.accounts) == 0 && c.refreshToken == "" && c.accessToken == "" && c.tokenStore == "" {
+		errs = append(errs, fmt.Errorf("either --refresh_token, --token_store or --access_token must be provided"))
+	}
+	if c.accessToken != "" && c.idToken == "" {
+		errs = append(errs, fmt.Errorf("if --access_token is provided, --id_token must also be provided"))
+	}
+	if len(c.accounts) == 0 && c.accessToken == "" && c.clientSecret == "" {
+		errs = append(errs, fmt.Errorf("missing --client_secret"))
 	}
-	if c.mqttUsername == "" {
-		return fmt.Errorf("missing --mqtt_username")
+	if c.kubernetesSecret != "" && c.kubernetesSecretKey == "" {
+		errs = append(errs, fmt.Errorf("missing --kubernetes_secret_key"))
 	}
-	if c.mqttPassword == "" {
-		return fmt.Errorf("missing --mqtt_password")
+	if c.tokenExpiryMargin < 0 {
+		errs = append(errs, fmt.Errorf("--token_expiry_margin must not be negative"))
 	}
-	return nil
+	return append(errs, c.validateAccounts()...)
 }
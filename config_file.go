@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"go.yaml.in/yaml/v3"
+)
+
+// configSections maps the sections of the config file to the prefix of their flags, e.g. url in the
+// mqtt section is --mqtt_url.
+var configSections = map[string]string{
+	"oauth":         "",
+	"mqtt":          "mqtt_",
+	"influxdb":      "influxdb_",
+	"homeassistant": "homeassistant_",
+	"prometheus":    "prometheus_",
+	"alerting":      "alert_",
+}
+
+// configAliases maps config file keys to flags whose name doesn't match.
+var configAliases = map[string]string{
+	"verbose": "v",
+}
+
+// loadConfigFile applies a YAML or TOML config file to the flags that weren't set on the command
+// line, listed in explicit, or through their environment variable, so the precedence is
+// file < env < flags. A secret is also left alone if its --<name>_file flag or <NAME>_FILE
+// variable is set, which would otherwise conflict with it. Every key maps to a flag, either at the top level (e.g. interval) or in a
+// section (e.g. url in mqtt), and its value is parsed by the flag itself. Lists are joined with
+// commas. The accounts list, which has no flag equivalent, is only read from the file.
+func loadConfigFile(path string, explicit map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	raw := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return fmt.Errorf("unsupported config file extension %q, expected .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	if v, ok := raw["accounts"]; ok {
+		delete(raw, "accounts")
+		if cfg.accounts, err = parseAccounts(v); err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		registerAccountSecretFiles(cfg.accounts)
+	}
+
+	values := map[string]configEntry{}
+	if err := flattenConfig(raw, "", "", values); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		e := values[name]
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("invalid config file %s: unknown key %q", path, e.path)
+		}
+		if flagSet(name, explicit) || flagSet(name+"_file", explicit) {
+			continue
+		}
+		if err := flag.Set(name, e.value); err != nil {
+			return fmt.Errorf("invalid config file %s: %s: %w", path, e.path, err)
+		}
+	}
+	return nil
+}
+
+// flagSet reports whether the flag was set on the command line or through its environment variable.
+func flagSet(name string, explicit map[string]bool) bool {
+	return explicit[name] || (flagEnv[name] != "" && os.Getenv(flagEnv[name]) != "")
+}
+
+// configEntry is a config file value and the key it was read from.
+type configEntry struct {
+	path  string
+	value string
+}
+
+// flattenConfig converts the nested config file values to flag names and values.
+func flattenConfig(m map[string]any, prefix, path string, out map[string]configEntry) error {
+	for k, v := range m {
+		p := path + k
+		if nested, ok := v.(map[string]any); ok {
+			if sp, ok := configSections[k]; ok && path == "" {
+				if err := flattenConfig(nested, sp, p+".", out); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := flattenConfig(nested, prefix+k+"_", p+".", out); err != nil {
+				return err
+			}
+			continue
+		}
+		s, err := configValue(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		name := prefix + k
+		if alias, ok := configAliases[name]; ok {
+			name = alias
+		}
+		if dup, ok := out[name]; ok {
+			return fmt.Errorf("%s and %s set the same option", dup.path, p)
+		}
+		out[name] = configEntry{path: p, value: s}
+	}
+	return nil
+}
+
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, e := range v {
+			s, err := configValue(e)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	case map[string]any:
+		return "", fmt.Errorf("unexpected table")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// saveConfig restores the flags, which point into cfg, and the secret files once the test ends.
+func saveConfig(t *testing.T) {
+	t.Helper()
+	saved, savedFiles := cfg, secretFiles
+	paths := make([]string, len(secretFiles))
+	for i, s := range secretFiles {
+		paths[i] = s.path
+	}
+	t.Cleanup(func() {
+		cfg, secretFiles = saved, savedFiles
+		for i, s := range secretFiles {
+			s.path = paths[i]
+		}
+	})
+}
+
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFlattenConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "sections",
+			yaml: `
+interval: 1h
+verbose: 2
+oauth: {client_secret: secret}
+mqtt: {url: tcp://broker:1883, discovery: true}
+influxdb: {tags: [site=home, room=office]}
+homeassistant: {token: ha}
+prometheus: {job: xfinity}
+alerting:
+  rules: [usage:80, usage:100]
+  ntfy: {url: https://ntfy.sh/topic}
+`,
+			want: map[string]string{
+				"interval":            "1h",
+				"v":                   "2",
+				"client_secret":       "secret",
+				"mqtt_url":            "tcp://broker:1883",
+				"mqtt_discovery":      "true",
+				"influxdb_tags":       "site=home,room=office",
+				"homeassistant_token": "ha",
+				"prometheus_job":      "xfinity",
+				"alert_rules":         "usage:80,usage:100",
+				"alert_ntfy_url":      "https://ntfy.sh/topic",
+			},
+		},
+		{
+			name: "nested outside a section",
+			yaml: `overage: {block: {gb: 50}}`,
+			want: map[string]string{"overage_block_gb": "50"},
+		},
+		{
+			name: "null",
+			yaml: `query: null`,
+			want: map[string]string{"query": ""},
+		},
+		{
+			name:    "same option twice",
+			yaml:    "mqtt_url: tcp://a\nmqtt: {url: tcp://b}",
+			wantErr: "set the same option",
+		},
+		{
+			name:    "table in a list",
+			yaml:    `alerting: {rules: [{usage: 80}]}`,
+			wantErr: "alerting.rules: unexpected table",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := map[string]any{}
+			if err := yaml.Unmarshal([]byte(tt.yaml), &raw); err != nil {
+				t.Fatal(err)
+			}
+			out := map[string]configEntry{}
+			err := flattenConfig(raw, "", "", out)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("flattenConfig() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("flattenConfig() = %v", err)
+			}
+			got := map[string]string{}
+			for name, e := range out {
+				got[name] = e.value
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("flattenConfig() = %v, want %v", got, tt.want)
+			}
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("%s = %q, want %q", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+	}{
+		{
+			name: "yaml",
+			file: "config.yaml",
+			data: `
+interval: 1h
+oauth: {client_secret: secret}
+mqtt: {url: tcp://broker:1883, username: file}
+alerting: {rules: [usage:50]}
+`,
+		},
+		{
+			name: "toml",
+			file: "config.toml",
+			data: `
+interval = "1h"
+
+[oauth]
+client_secret = "secret"
+
+[mqtt]
+url = "tcp://broker:1883"
+username = "file"
+
+[alerting]
+rules = ["usage:50"]
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saveConfig(t)
+			cfg.clientSecret, cfg.mqttURL, cfg.mqttUsername = "", "", ""
+			if err := loadConfigFile(writeFile(t, tt.file, tt.data), nil); err != nil {
+				t.Fatalf("loadConfigFile() = %v", err)
+			}
+			if cfg.interval.String() != "1h0m0s" || cfg.clientSecret != "secret" || cfg.mqttURL != "tcp://broker:1883" ||
+				cfg.mqttUsername != "file" || cfg.alertRules != "usage:50" {
+				t.Errorf("got interval %v, client secret %q, MQTT url %q and username %q, alert rules %q",
+					cfg.interval, cfg.clientSecret, cfg.mqttURL, cfg.mqttUsername, cfg.alertRules)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFilePrecedence(t *testing.T) {
+	saveConfig(t)
+	cfg.mqttURL, cfg.mqttUsername, cfg.clientSecret, cfg.refreshToken = "", "flag", "", ""
+	path := writeFile(t, "config.yaml", `
+oauth: {client_secret: file, refresh_token: file}
+mqtt: {url: tcp://broker:1883, username: file, password: file}
+`)
+	t.Setenv(flagEnv["mqtt_password"], "env")
+	cfg.mqttPassword = "env"
+	// A secret file set through the environment or on the command line wins over the secret itself.
+	t.Setenv(flagEnv["client_secret_file"], "/run/secrets/client_secret")
+	explicit := map[string]bool{"mqtt_username": true, "refresh_token_file": true}
+
+	if err := loadConfigFile(path, explicit); err != nil {
+		t.Fatalf("loadConfigFile() = %v", err)
+	}
+	for _, c := range []struct{ name, got, want string }{
+		{"mqtt_url", cfg.mqttURL, "tcp://broker:1883"},
+		{"mqtt_username", cfg.mqttUsername, "flag"},
+		{"mqtt_password", cfg.mqttPassword, "env"},
+		{"client_secret", cfg.clientSecret, ""},
+		{"refresh_token", cfg.refreshToken, ""},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s = %q, want %q", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		wantErr string
+	}{
+		{name: "unknown key", file: "config.yaml", data: "mqtt: {hostname: broker}", wantErr: `unknown key "mqtt.hostname"`},
+		{name: "config key", file: "config.yaml", data: "config: other.yaml", wantErr: `unknown key "config"`},
+		{name: "invalid value", file: "config.yaml", data: "interval: often", wantErr: "interval"},
+		{name: "invalid syntax", file: "config.toml", data: "interval = ", wantErr: "failed to parse"},
+		{name: "unsupported extension", file: "config.json", data: "{}", wantErr: "unsupported config file extension"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saveConfig(t)
+			err := loadConfigFile(writeFile(t, tt.file, tt.data), nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfigFile() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+
+	"github.com/csobrinho/xfinity-usage/xfinity"
+)
+
+// overageCostModel prices the usage over the allowance in blocks, e.g. $10 per 50 GB, up to a
+// maximum charge per billing cycle.
+type overageCostModel struct {
+	blockGB    int
+	blockPrice int
+	// maxCharge overrides the maximum charge reported by the API, 0 uses the API's.
+	maxCharge int
+}
+
+// overageCost is what the cycle's overage will cost.
+type overageCost struct {
+	// Current is the charge for the usage so far.
+	Current int
+	// Projected is the charge for the estimated usage at the end of the cycle.
+	Projected int
+	// NextBlock is the charge added by the next block, and NextBlockAt the usage that starts it.
+	NextBlock   int
+	NextBlockAt int
+	// Waived reports whether a courtesy credit covers the cycle's overage.
+	Waived bool
+}
+
+// estimate prices the current and estimated usage. It returns nil for plans without an allowance.
+// Xfinity waives the overage of a cycle with a courtesy credit, either one already applied to the
+// cycle or one still remaining, which would be used the first time the allowance is exceeded,
+// unless the account is already in paid overage.
+func (m overageCostModel) estimate(u *xfinity.Usage, attributes *UsageAttributes, currentGB float32) *overageCost {
+	if attributes.AllowableUsage == nil || m.blockGB <= 0 {
+		return nil
+	}
+	usage := u.Data.Account.Internet.Usage
+	maxCharge := m.maxCharge
+	if maxCharge == 0 && attributes.MaximumOverageCharge != nil {
+		maxCharge = *attributes.MaximumOverageCharge
+	}
+	waived := usage.MonthlyUsage[0].CourtesyCredit
+	if usage.Courtesy != nil && usage.Courtesy.RemainingCourtesy != nil && *usage.Courtesy.RemainingCourtesy > 0 {
+		waived = true
+	}
+	if usage.InPaidOverage != nil && *usage.InPaidOverage {
+		waived = false
+	}
+
+	allowable := *attributes.AllowableUsage
+	blocks := m.blocks(float64(currentGB) - float64(allowable))
+	c := &overageCost{
+		Current:     m.charge(blocks, maxCharge),
+		Projected:   m.charge(m.blocks(float64(attributes.UsageEstimated)-float64(allowable)), maxCharge),
+		NextBlockAt: allowable + blocks*m.blockGB,
+		Waived:      waived,
+	}
+	c.NextBlock = m.charge(blocks+1, maxCharge) - c.Current
+	if waived {
+		c.Current, c.Projected, c.NextBlock = 0, 0, 0
+	}
+	return c
+}
+
+// blocks returns the number of started blocks in overGB.
+func (m overageCostModel) blocks(overGB float64) int {
+	if overGB <= 0 {
+		return 0
+	}
+	return int(math.Ceil(overGB / float64(m.blockGB)))
+}
+
+// charge returns the price of the blocks, capped at maxCharge unless it is 0.
+func (m overageCostModel) charge(blocks, maxCharge int) int {
+	charge := blocks * m.blockPrice
+	if maxCharge > 0 {
+		charge = min(charge, maxCharge)
+	}
+	return charge
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/csobrinho/xfinity-usage/xfinity"
+)
+
+// testCourtesyUsage returns an API response with the courtesy credits and paid overage state.
+func testCourtesyUsage(t *testing.T, courtesyCredit bool, remainingCourtesy int, inPaidOverage bool) *xfinity.Usage {
+	t.Helper()
+	var u xfinity.Usage
+	err := json.Unmarshal([]byte(fmt.Sprintf(`{"data":{"accountByServiceAccountId":{"internet":{"usage":{
+		"inPaidOverage":%t,
+		"courtesy":{"totalAllowableCourtesy":1,"usedCourtesy":%d,"remainingCourtesy":%d},
+		"monthlyUsage":[{"policy":"limited","courtesyCredit":%t}]
+	}}}}}`, inPaidOverage, 1-remainingCourtesy, remainingCourtesy, courtesyCredit)), &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &u
+}
+
+func TestOverageCostEstimate(t *testing.T) {
+	model := overageCostModel{blockGB: 50, blockPrice: 10, maxCharge: 100}
+	allowable, apiMaxCharge := 1250, 50
+	tests := []struct {
+		name string
+		// model defaults to $10 per 50 GB up to $100.
+		model          *overageCostModel
+		allowable      *int
+		apiMaxCharge   *int
+		currentGB      float32
+		estimatedGB    float32
+		courtesyCredit bool
+		remaining      int
+		inPaidOverage  bool
+		want           *overageCost
+	}{
+		{
+			name:        "under the allowance",
+			allowable:   &allowable,
+			currentGB:   1000,
+			estimatedGB: 1200,
+			want:        &overageCost{NextBlock: 10, NextBlockAt: 1250},
+		},
+		{
+			name:        "exactly on the allowance",
+			allowable:   &allowable,
+			currentGB:   1250,
+			estimatedGB: 1250,
+			want:        &overageCost{NextBlock: 10, NextBlockAt: 1250},
+		},
+		{
+			name:        "exactly on a block boundary",
+			allowable:   &allowable,
+			currentGB:   1300,
+			estimatedGB: 1300.5,
+			want:        &overageCost{Current: 10, Projected: 20, NextBlock: 10, NextBlockAt: 1300},
+		},
+		{
+			name:        "partial block",
+			allowable:   &allowable,
+			currentGB:   1260,
+			estimatedGB: 1400,
+			want:        &overageCost{Current: 10, Projected: 30, NextBlock: 10, NextBlockAt: 1300},
+		},
+		{
+			name:        "next block reaches the cap",
+			allowable:   &allowable,
+			currentGB:   1690,
+			estimatedGB: 1700,
+			want:        &overageCost{Current: 90, Projected: 90, NextBlock: 10, NextBlockAt: 1700},
+		},
+		{
+			name:        "above the cap",
+			allowable:   &allowable,
+			currentGB:   1800,
+			estimatedGB: 2000,
+			want:        &overageCost{Current: 100, Projected: 100, NextBlock: 0, NextBlockAt: 1800},
+		},
+		{
+			name:         "cap reported by the API",
+			model:        &overageCostModel{blockGB: 50, blockPrice: 10},
+			allowable:    &allowable,
+			apiMaxCharge: &apiMaxCharge,
+			currentGB:    1800,
+			estimatedGB:  2000,
+			want:         &overageCost{Current: 50, Projected: 50, NextBlock: 0, NextBlockAt: 1800},
+		},
+		{
+			name:         "configured cap overrides the API's",
+			allowable:    &allowable,
+			apiMaxCharge: &apiMaxCharge,
+			currentGB:    1800,
+			estimatedGB:  2000,
+			want:         &overageCost{Current: 100, Projected: 100, NextBlock: 0, NextBlockAt: 1800},
+		},
+		{
+			name:        "courtesy credit remaining",
+			allowable:   &allowable,
+			currentGB:   1300,
+			estimatedGB: 1400,
+			remaining:   1,
+			want:        &overageCost{NextBlockAt: 1300, Waived: true},
+		},
+		{
+			name:           "courtesy credit applied to the cycle",
+			allowable:      &allowable,
+			currentGB:      1300,
+			estimatedGB:    1400,
+			courtesyCredit: true,
+			want:           &overageCost{NextBlockAt: 1300, Waived: true},
+		},
+		{
+			name:          "courtesy credit remaining in paid overage",
+			allowable:     &allowable,
+			currentGB:     1300,
+			estimatedGB:   1400,
+			remaining:     1,
+			inPaidOverage: true,
+			want:          &overageCost{Current: 10, Projected: 30, NextBlock: 10, NextBlockAt: 1300},
+		},
+		{
+			name:        "unlimited",
+			currentGB:   5000,
+			estimatedGB: 6000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := model
+			if tt.model != nil {
+				m = *tt.model
+			}
+			attributes := &UsageAttributes{AllowableUsage: tt.allowable, MaximumOverageCharge: tt.apiMaxCharge, UsageEstimated: tt.estimatedGB}
+			u := testCourtesyUsage(t, tt.courtesyCredit, tt.remaining, tt.inPaidOverage)
+			got := m.estimate(u, attributes, tt.currentGB)
+			switch {
+			case tt.want == nil && got != nil:
+				t.Errorf("estimate() = %+v, want nil", *got)
+			case tt.want != nil && (got == nil || *got != *tt.want):
+				t.Errorf("estimate() = %+v, want %+v", got, *tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"time"
+)
+
+// deltasLookback is how far back snapshots are needed to compute every delta window.
+const deltasLookback = 8 * 24 * time.Hour
+
+// usageDeltas is the usage consumed over recent windows, derived from successive snapshots.
+type usageDeltas struct {
+	LastHour  float32
+	Today     float32
+	Yesterday float32
+	Last7Days float32
+}
+
+// usageInterval is the usage consumed between two successive snapshots.
+type usageInterval struct {
+	from, to time.Time
+	gb       float32
+}
+
+// usageIntervals converts cumulative snapshots, oldest first, into the usage consumed between
+// each pair. Within a billing cycle the usage is measured against the highest value seen so far,
+// so a temporary dip reported by the API is ignored instead of being counted twice. When the
+// cycle rolls over (the start date changes), the whole usage of the new cycle is attributed to
+// the time since it started.
+func usageIntervals(snapshots []snapshot) []usageInterval {
+	var out []usageInterval
+	var highest float32
+	for i := 1; i < len(snapshots); i++ {
+		prev, cur := snapshots[i-1], snapshots[i]
+		if i == 1 {
+			highest = prev.UsageGB
+		}
+		from := prev.Time
+		var gb float32
+		if cur.Monthly.StartDate != prev.Monthly.StartDate {
+			if start, err := time.ParseInLocation("2006-01-02", cur.Monthly.StartDate, time.Local); err == nil && start.After(from) && start.Before(cur.Time) {
+				from = start
+			}
+			gb = cur.UsageGB
+			highest = cur.UsageGB
+		} else if cur.UsageGB > highest {
+			gb = cur.UsageGB - highest
+			highest = cur.UsageGB
+		}
+		if cur.Time.After(from) {
+			out = append(out, usageInterval{from: from, to: cur.Time, gb: gb})
+		}
+	}
+	return out
+}
+
+// sumUsage returns the usage consumed in [from, to), assuming it was spread evenly over each
+// interval.
+func sumUsage(intervals []usageInterval, from, to time.Time) float32 {
+	var total float64
+	for _, iv := range intervals {
+		start, end := maxTime(iv.from, from), minTime(iv.to, to)
+		if !end.After(start) {
+			continue
+		}
+		total += float64(iv.gb) * float64(end.Sub(start)) / float64(iv.to.Sub(iv.from))
+	}
+	return float32(total)
+}
+
+// computeDeltas returns the usage consumed in the last hour, today, yesterday and the last 7
+// days, in local time. snapshots must be sorted oldest first and should include the latest one.
+func computeDeltas(snapshots []snapshot, now time.Time) usageDeltas {
+	intervals := usageIntervals(snapshots)
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	return usageDeltas{
+		LastHour:  sumUsage(intervals, now.Add(-time.Hour), now),
+		Today:     sumUsage(intervals, midnight, now),
+		Yesterday: sumUsage(intervals, midnight.AddDate(0, 0, -1), midnight),
+		Last7Days: sumUsage(intervals, now.AddDate(0, 0, -7), now),
+	}
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
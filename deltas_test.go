@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/csobrinho/xfinity-usage/xfinity"
+)
+
+// at returns the local time of the given day of October 2026 and hour.
+func at(day, hour int) time.Time {
+	return time.Date(2026, time.October, day, hour, 0, 0, 0, time.Local)
+}
+
+func testSnapshot(t time.Time, cycle string, gb float32) snapshot {
+	return snapshot{Time: t, UsageGB: gb, Monthly: xfinity.UsageMonthly{StartDate: cycle}}
+}
+
+func TestUsageIntervals(t *testing.T) {
+	tests := []struct {
+		name      string
+		snapshots []snapshot
+		want      []usageInterval
+	}{
+		{
+			name:      "single snapshot",
+			snapshots: []snapshot{testSnapshot(at(10, 0), "2026-10-01", 100)},
+		},
+		{
+			name: "dip and recovery",
+			snapshots: []snapshot{
+				testSnapshot(at(10, 0), "2026-10-01", 100),
+				testSnapshot(at(10, 1), "2026-10-01", 90),
+				testSnapshot(at(10, 2), "2026-10-01", 95),
+				testSnapshot(at(10, 3), "2026-10-01", 110),
+			},
+			want: []usageInterval{
+				{from: at(10, 0), to: at(10, 1), gb: 0},
+				{from: at(10, 1), to: at(10, 2), gb: 0},
+				{from: at(10, 2), to: at(10, 3), gb: 10},
+			},
+		},
+		{
+			name: "cycle rollover",
+			snapshots: []snapshot{
+				testSnapshot(time.Date(2026, time.September, 30, 22, 0, 0, 0, time.Local), "2026-09-01", 500),
+				testSnapshot(at(1, 2), "2026-10-01", 3),
+				testSnapshot(at(1, 3), "2026-10-01", 4),
+			},
+			want: []usageInterval{
+				{from: at(1, 0), to: at(1, 2), gb: 3},
+				{from: at(1, 2), to: at(1, 3), gb: 1},
+			},
+		},
+		{
+			name: "cycle rollover with an unknown start",
+			snapshots: []snapshot{
+				testSnapshot(at(1, 1), "2026-09-01", 500),
+				testSnapshot(at(1, 2), "", 3),
+			},
+			want: []usageInterval{{from: at(1, 1), to: at(1, 2), gb: 3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := usageIntervals(tt.snapshots)
+			if len(got) != len(tt.want) {
+				t.Fatalf("usageIntervals() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !got[i].from.Equal(tt.want[i].from) || !got[i].to.Equal(tt.want[i].to) || got[i].gb != tt.want[i].gb {
+					t.Errorf("interval %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestComputeDeltas(t *testing.T) {
+	snapshots := []snapshot{
+		testSnapshot(at(7, 12), "2026-10-01", 0),
+		// Entirely before the last 7 days.
+		testSnapshot(at(8, 12), "2026-10-01", 70),
+		testSnapshot(at(14, 0), "2026-10-01", 100),
+		// Yesterday.
+		testSnapshot(at(15, 0), "2026-10-01", 124),
+		testSnapshot(at(15, 10), "2026-10-01", 135),
+		// Spans the last hour, which gets half of it.
+		testSnapshot(at(15, 12), "2026-10-01", 139),
+	}
+	tests := []struct {
+		name      string
+		snapshots []snapshot
+		now       time.Time
+		want      usageDeltas
+	}{
+		{
+			name:      "latest snapshot",
+			snapshots: snapshots,
+			now:       at(15, 12),
+			want:      usageDeltas{LastHour: 2, Today: 15, Yesterday: 24, Last7Days: 69},
+		},
+		{
+			// The last 7 days start at 9 01:00, 13 of the 132 hours of the 30 GB interval earlier.
+			name:      "next day",
+			snapshots: snapshots,
+			now:       at(16, 1),
+			want:      usageDeltas{LastHour: 0, Today: 0, Yesterday: 15, Last7Days: 69 - 30*13.0/132},
+		},
+		{
+			name:      "single snapshot",
+			snapshots: snapshots[len(snapshots)-1:],
+			now:       at(15, 12),
+			want:      usageDeltas{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := computeDeltas(tt.snapshots, tt.now)
+			for _, c := range []struct {
+				name      string
+				got, want float32
+			}{
+				{"LastHour", got.LastHour, tt.want.LastHour},
+				{"Today", got.Today, tt.want.Today},
+				{"Yesterday", got.Yesterday, tt.want.Yesterday},
+				{"Last7Days", got.Last7Days, tt.want.Last7Days},
+			} {
+				if math.Abs(float64(c.got-c.want)) > 0.01 {
+					t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// discoveryDevice groups all the entities under a single device in Home Assistant.
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+// discoveryConfig is the Home Assistant MQTT discovery payload of a sensor.
+type discoveryConfig struct {
+	Name                string          `json:"name"`
+	UniqueID            string          `json:"unique_id"`
+	StateTopic          string          `json:"state_topic"`
+	ValueTemplate       string          `json:"value_template,omitempty"`
+	JSONAttributesTopic string          `json:"json_attributes_topic,omitempty"`
+	UnitOfMeasurement   string          `json:"unit_of_measurement,omitempty"`
+	DeviceClass         string          `json:"device_class,omitempty"`
+	StateClass          string          `json:"state_class,omitempty"`
+	Icon                string          `json:"icon,omitempty"`
+	AvailabilityTopic   string          `json:"availability_topic,omitempty"`
+	Device              discoveryDevice `json:"device"`
+}
+
+// discoveryEntity describes one sensor derived from the published state or attributes.
+type discoveryEntity struct {
+	objectID    string
+	name        string
+	field       string // Attribute read by the value template, empty for the state topic.
+	unit        string
+	deviceClass string
+	stateClass  string
+	icon        string
+	// present reports whether the attribute is available, otherwise the entity is removed.
+	present func(a *UsageAttributes) bool
+}
+
+func always(*UsageAttributes) bool { return true }
+
+var discoveryEntities = []discoveryEntity{
+	{objectID: "usage", name: "Usage", unit: attrUnitOfMeasurement, deviceClass: attrDeviceClass, stateClass: attrStateClass, icon: attrIcon, present: always},
+	{objectID: "usage_remaining", name: "Usage remaining", field: "usage_remaining", unit: attrUnitOfMeasurement, deviceClass: attrDeviceClass, stateClass: attrStateClass, icon: "mdi:gauge",
+		present: func(a *UsageAttributes) bool { return a.UsageRemaining != nil }},
+	{objectID: "usage_estimated", name: "Usage estimated", field: "usage_estimated", unit: attrUnitOfMeasurement, deviceClass: attrDeviceClass, stateClass: attrStateClass, icon: "mdi:chart-line", present: always},
+	{objectID: "usage_estimated_low", name: "Usage estimated low", field: "usage_estimated_low", unit: attrUnitOfMeasurement, deviceClass: attrDeviceClass, stateClass: attrStateClass, icon: "mdi:chart-bell-curve",
+		present: func(a *UsageAttributes) bool { return a.UsageEstimatedLow != nil }},
+	{objectID: "usage_estimated_high", name: "Usage estimated high", field: "usage_estimated_high", unit: attrUnitOfMeasurement, deviceClass: attrDeviceClass, stateClass: attrStateClass, icon: "mdi:chart-bell-curve",
+		present: func(a *UsageAttributes) bool { return a.UsageEstimatedHigh != nil }},
+	{objectID: "projected_cap_date", name: "Projected cap date", field: "projected_cap_date", deviceClass: "date", icon: "mdi:calendar-alert",
+		present: func(a *UsageAttributes) bool { return a.ProjectedCapDate != "" }},
+	{objectID: "usage_daily_average", name: "Daily average usage", field: "usage_daily_average", unit: attrUnitOfMeasurement, deviceClass: attrDeviceClass, stateClass: attrStateClass, icon: "mdi:chart-bar", present: always},
+	{objectID: "usage_last_hour", name: "Usage last hour", field: "usage_last_hour", unit: attrUnitOfMeasurement, deviceClass: attrDeviceClass, stateClass: attrStateClass, icon: "mdi:clock-outline",
+		present: func(a *UsageAttributes) bool { return a.UsageLastHour != nil }},
+	{objectID: "usage_today", name: "Usage today", field: "usage_today", unit: attrUnitOfMeasurement, deviceClass: attrDeviceClass, stateClass: attrStateClass, icon: "mdi:calendar-today",
+		present: func(a *UsageAttributes) bool { return a.UsageToday != nil }},
+	{objectID: "usage_yesterday", name: "Usage yesterday", field: "usage_yesterday", unit: attrUnitOfMeasurement, deviceClass: attrDeviceClass, stateClass: attrStateClass, icon: "mdi:calendar-arrow-left",
+		present: func(a *UsageAttributes) bool { return a.UsageYesterday != nil }},
+	{objectID: "usage_last_7_days", name: "Usage last 7 days", field: "usage_last_7_days", unit: attrUnitOfMeasurement, deviceClass: attrDeviceClass, stateClass: attrStateClass, icon: "mdi:calendar-week",
+		present: func(a *UsageAttributes) bool { return a.UsageLast7Days != nil }},
+	{objectID: "days_remaining", name: "Days remaining", field: "days_remaining", unit: "d", deviceClass: "duration", stateClass: attrStateClass, icon: "mdi:calendar-clock", present: always},
+	{objectID: "overage_used", name: "Overage used", field: "overage_used", unit: attrUnitOfMeasurement, deviceClass: attrDeviceClass, stateClass: attrStateClass, icon: "mdi:alert-circle",
+		present: func(a *UsageAttributes) bool { return a.OverageUsed != nil }},
+	{objectID: "overage_charges", name: "Overage charges", field: "overage_charges", unit: "USD", deviceClass: "monetary", icon: "mdi:currency-usd",
+		present: func(a *UsageAttributes) bool { return a.OverageCharges != nil }},
+	{objectID: "overage_projected_cost", name: "Overage projected cost", field: "overage_projected_cost", unit: "USD", deviceClass: "monetary", icon: "mdi:cash-clock",
+		present: func(a *UsageAttributes) bool { return a.OverageProjectedCost != nil }},
+	{objectID: "overage_next_block_cost", name: "Overage next block cost", field: "overage_next_block_cost", unit: "USD", deviceClass: "monetary", icon: "mdi:cash-plus",
+		present: func(a *UsageAttributes) bool { return a.OverageNextBlockCost != nil }},
+	{objectID: "plan_download_speed", name: "Plan download speed", field: "plan_download_speed_gbps", unit: "Gbit/s", deviceClass: "data_rate", stateClass: attrStateClass, icon: "mdi:download-network",
+		present: func(a *UsageAttributes) bool { return a.PlanDownloadSpeed != nil }},
+	{objectID: "plan_upload_speed", name: "Plan upload speed", field: "plan_upload_speed_gbps", unit: "Gbit/s", deviceClass: "data_rate", stateClass: attrStateClass, icon: "mdi:upload-network",
+		present: func(a *UsageAttributes) bool { return a.PlanUploadSpeed != nil }},
+}
+
+// discoveryTopic returns the retained config topic of an entity.
+func (c mqttConfig) discoveryTopic(objectID string) string {
+	return fmt.Sprintf("%s/sensor/%s/%s/config", c.discoveryPrefix, c.nodeID, objectID)
+}
+
+// discoveryConfigs builds the discovery payload of every entity, keyed by topic. Entities whose
+// attribute is not available (e.g. unlimited plans have no allowance) get an empty payload, which
+// removes them from Home Assistant.
+func (c mqttConfig) discoveryConfigs(attributes *UsageAttributes) (map[string][]byte, error) {
+	name := "Xfinity Internet"
+	if c.account != "" {
+		name += " (" + c.account + ")"
+	}
+	device := discoveryDevice{
+		Identifiers:  []string{c.nodeID},
+		Name:         name,
+		Manufacturer: "Xfinity",
+		Model:        attributes.PlanName,
+		SWVersion:    version,
+	}
+	configs := make(map[string][]byte, len(discoveryEntities))
+	for _, e := range discoveryEntities {
+		topic := c.discoveryTopic(e.objectID)
+		if !e.present(attributes) {
+			configs[topic] = []byte{}
+			continue
+		}
+		dc := discoveryConfig{
+			Name:              e.name,
+			UniqueID:          c.nodeID + "_" + e.objectID,
+			StateTopic:        c.stateTopic,
+			UnitOfMeasurement: e.unit,
+			DeviceClass:       e.deviceClass,
+			StateClass:        e.stateClass,
+			Icon:              e.icon,
+			AvailabilityTopic: c.availabilityTopic,
+			Device:            device,
+		}
+		if e.field == "" {
+			dc.JSONAttributesTopic = c.attributesTopic
+		} else {
+			dc.StateTopic = c.attributesTopic
+			dc.ValueTemplate = fmt.Sprintf("{{ value_json.%s }}", e.field)
+		}
+		payload, err := json.Marshal(dc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s discovery config: %w", e.objectID, err)
+		}
+		configs[topic] = payload
+	}
+	return configs, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// Formats of the dry run output.
+const (
+	outputJSON  = "json"
+	outputTable = "table"
+	outputYAML  = "yaml"
+)
+
+// dryRunReport is what a dry run prints instead of publishing to the sinks.
+type dryRunReport struct {
+	Account    string           `json:"account,omitempty"`
+	State      string           `json:"state"`
+	Attributes *UsageAttributes `json:"attributes"`
+	Messages   []dryRunMessage  `json:"messages"`
+}
+
+// dryRunMessage is a message that would have been published. JSON payloads are kept as JSON.
+type dryRunMessage struct {
+	Topic   string `json:"topic"`
+	Payload any    `json:"payload"`
+}
+
+// newDryRunReport collects the messages the MQTT sink would publish on a fetch, if it is enabled:
+// the discovery configs, state, attributes, history and availability, in the order they are
+// published.
+func newDryRunReport(account string, publishers []publisher, usage float32, attributes *UsageAttributes, history *UsageHistory) (*dryRunReport, error) {
+	var msgs []mqttMessage
+	for _, p := range publishers {
+		m, ok := p.(*mqttPublisher)
+		if !ok {
+			continue
+		}
+		var err error
+		if msgs, err = m.cfg.usageMessages(usage, attributes); err != nil {
+			return nil, err
+		}
+		hm, err := m.cfg.historyMessage(history)
+		if err != nil {
+			return nil, err
+		}
+		if hm != nil {
+			msgs = append(msgs, *hm)
+		}
+		if m.cfg.availabilityTopic != "" {
+			msgs = append(msgs, mqttMessage{topic: m.cfg.availabilityTopic, payload: []byte(availabilityOnline)})
+		}
+	}
+
+	r := &dryRunReport{Account: account, State: fmt.Sprintf("%.2f", usage), Attributes: attributes}
+	for _, msg := range msgs {
+		var payload any = string(msg.payload)
+		if len(msg.payload) > 0 && json.Valid(msg.payload) && (msg.payload[0] == '{' || msg.payload[0] == '[') {
+			payload = json.RawMessage(msg.payload)
+		}
+		r.Messages = append(r.Messages, dryRunMessage{Topic: msg.topic, Payload: payload})
+	}
+	return r, nil
+}
+
+// write prints the report in the given format.
+func (r *dryRunReport) write(w io.Writer, format string) error {
+	var buf bytes.Buffer
+	switch format {
+	case outputJSON:
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal dry run report: %w", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	case outputYAML:
+		data, err := toYAML(r)
+		if err != nil {
+			return err
+		}
+		buf.WriteString("---\n")
+		buf.Write(data)
+	default:
+		if err := r.writeTable(&buf); err != nil {
+			return err
+		}
+	}
+	// A single write, so the reports of concurrent accounts don't interleave.
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (r *dryRunReport) writeTable(w io.Writer) error {
+	attrs, err := json.Marshal(r.Attributes)
+	if err != nil {
+		return fmt.Errorf("failed to marshal attributes: %w", err)
+	}
+	fields, err := orderedFields(attrs)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if r.Account != "" {
+		fmt.Fprintf(tw, "ACCOUNT\t%s\n", r.Account)
+	}
+	fmt.Fprintf(tw, "STATE\t%s\n\nATTRIBUTE\tVALUE\n", r.State)
+	for _, f := range fields {
+		fmt.Fprintf(tw, "%s\t%s\n", f[0], f[1])
+	}
+	fmt.Fprintf(tw, "\nTOPIC\tPAYLOAD\n")
+	for _, m := range r.Messages {
+		payload := fmt.Sprint(m.Payload)
+		switch p := m.Payload.(type) {
+		case json.RawMessage:
+			payload = fmt.Sprintf("(%d bytes of JSON)", len(p))
+		case string:
+			if p == "" {
+				payload = "(empty, removes the entity)"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", m.Topic, payload)
+	}
+	fmt.Fprintln(tw)
+	return tw.Flush()
+}
+
+// orderedFields returns the keys and values of a JSON object in their original order.
+func orderedFields(data []byte) ([][2]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("failed to parse attributes: %w", err)
+	}
+	var fields [][2]string
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse attributes: %w", err)
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, fmt.Errorf("failed to parse attributes: %w", err)
+		}
+		s := string(value)
+		var str string
+		if json.Unmarshal(value, &str) == nil {
+			s = str
+		}
+		fields = append(fields, [2]string{fmt.Sprint(key), s})
+	}
+	return fields, nil
+}
+
+// toYAML converts v to YAML through its JSON encoding, so the JSON field names and order are kept.
+func toYAML(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal dry run report: %w", err)
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, fmt.Errorf("failed to convert dry run report to yaml: %w", err)
+	}
+	blockStyle(&node)
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return nil, fmt.Errorf("failed to convert dry run report to yaml: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// blockStyle resets the JSON flow style and quoting of the nodes to the YAML defaults.
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/csobrinho/xfinity-usage/xfinity"
+	log "github.com/google/logger"
+)
+
+// forecastModel selects how the end of cycle usage is projected.
+type forecastModel string
+
+// Forecast models.
+const (
+	// forecastLinear extrapolates the average rate since the start of the cycle.
+	forecastLinear forecastModel = "linear"
+	// forecastEWMA extrapolates an exponentially weighted average of the recent daily usage.
+	forecastEWMA forecastModel = "ewma"
+	// forecastSeasonal weights the recent daily usage by the day of week pattern in the history.
+	forecastSeasonal forecastModel = "seasonal"
+	// forecastBlend blends the current rate with the previous cycle's, trusting the current one
+	// more as the cycle progresses.
+	forecastBlend forecastModel = "blend"
+)
+
+var forecastModels = []forecastModel{forecastLinear, forecastEWMA, forecastSeasonal, forecastBlend}
+
+const (
+	// forecastLookback is how much history the models learn from.
+	forecastLookback = 28 * 24 * time.Hour
+	// forecastEWMAAlpha is the weight of the most recent day in the ewma model.
+	forecastEWMAAlpha = 0.3
+	// forecastZ is the z-score of the 90% confidence band.
+	forecastZ = 1.645
+	// forecastMinDays is the number of full days of history the ewma model needs.
+	forecastMinDays = 3
+)
+
+func parseForecastModel(s string) (forecastModel, error) {
+	for _, m := range forecastModels {
+		if string(m) == s {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("unknown forecast model %q, expected one of %v", s, forecastModels)
+}
+
+// forecastInput is everything the models can learn from.
+type forecastInput struct {
+	now         time.Time
+	currentGB   float32
+	start, end  time.Time
+	allowableGB *int
+	// previousGB and previousDays describe the previous billing cycle, if the API returned it.
+	previousGB   *float32
+	previousDays float64
+	// snapshots is the recent history, oldest first. It may be empty.
+	snapshots []snapshot
+}
+
+// newForecastInput builds the model input from the API response and the recent history.
+func newForecastInput(u *xfinity.Usage, currentGB float32, snapshots []snapshot, now time.Time) (*forecastInput, error) {
+	months := u.Data.Account.Internet.Usage.MonthlyUsage
+	cur := months[0]
+	start, errStart := time.ParseInLocation("2006-01-02", cur.StartDate, time.Local)
+	end, errEnd := time.ParseInLocation("2006-01-02", cur.EndDate, time.Local)
+	if errStart != nil || errEnd != nil {
+		return nil, fmt.Errorf("failed to parse dates (start: %q, end: %q): %v, %v", cur.StartDate, cur.EndDate, errStart, errEnd)
+	}
+	if !end.After(start) {
+		return nil, fmt.Errorf("invalid billing cycle %s - %s", cur.StartDate, cur.EndDate)
+	}
+	in := &forecastInput{
+		now:       now,
+		currentGB: currentGB,
+		start:     start,
+		end:       end,
+		snapshots: snapshots,
+	}
+	if cur.Policy != xfinity.PolicyUnlimited {
+		if allowableGB, err := cur.AllowableUsage.GB(); err == nil {
+			agb := int(allowableGB)
+			in.allowableGB = &agb
+		}
+	}
+	if len(months) > 1 {
+		prev := months[1]
+		prevGB, err := prev.CurrentUsage.GB()
+		prevStart, errStart := time.ParseInLocation("2006-01-02", prev.StartDate, time.Local)
+		prevEnd, errEnd := time.ParseInLocation("2006-01-02", prev.EndDate, time.Local)
+		if err == nil && errStart == nil && errEnd == nil && prevEnd.After(prevStart) {
+			in.previousGB = &prevGB
+			in.previousDays = prevEnd.Sub(prevStart).Hours() / 24
+		}
+	}
+	return in, nil
+}
+
+// usageForecast is the projected usage at the end of the billing cycle.
+type usageForecast struct {
+	Model     forecastModel
+	Estimated float32
+	// Low and High bound the 90% confidence band.
+	Low  float32
+	High float32
+	// CapDate is when the allowance is projected to be exceeded, if within this cycle.
+	CapDate *time.Time
+}
+
+// forecastUsage projects the end of cycle usage with the given model. Models that lack the
+// history they need fall back to linear.
+func forecastUsage(model forecastModel, in *forecastInput) usageForecast {
+	daily := dailyTotals(in.snapshots, in.now)
+	linear := linearRate(in)
+
+	used := model
+	var rate func(time.Weekday) float64
+	switch model {
+	case forecastEWMA:
+		if r, ok := ewmaRate(daily); ok {
+			rate = constantRate(r)
+		}
+	case forecastSeasonal:
+		rate = seasonalRate(daily)
+	case forecastBlend:
+		if r, ok := blendRate(in, linear); ok {
+			rate = constantRate(r)
+		}
+	}
+	if rate == nil {
+		if model != forecastLinear {
+			log.V(1).Infof("forecast: not enough history for the %s model, using linear", model)
+		}
+		used = forecastLinear
+		rate = constantRate(linear)
+	}
+
+	estimated, capDate := project(in, rate)
+
+	// The band grows with the square root of the remaining days, using the observed day to day
+	// deviation, or a conservative 50% of the rate when there isn't enough history.
+	sd := stddev(daily)
+	if len(daily) < forecastMinDays {
+		sd = 0.5 * linear
+	}
+	remainingDays := max(in.end.Sub(in.now).Hours()/24, 0)
+	margin := forecastZ * sd * math.Sqrt(remainingDays)
+
+	return usageForecast{
+		Model:     used,
+		Estimated: float32(estimated),
+		Low:       float32(max(estimated-margin, float64(in.currentGB))),
+		High:      float32(estimated + margin),
+		CapDate:   capDate,
+	}
+}
+
+// project integrates the daily rate from now until the end of the cycle, returning the
+// estimated usage and when it would cross the allowance.
+func project(in *forecastInput, rate func(time.Weekday) float64) (float64, *time.Time) {
+	total := float64(in.currentGB)
+	var capDate *time.Time
+	crossed := in.allowableGB != nil && total > float64(*in.allowableGB)
+	for t := in.now; t.Before(in.end); {
+		y, m, d := t.Date()
+		next := minTime(time.Date(y, m, d+1, 0, 0, 0, 0, t.Location()), in.end)
+		r := rate(t.Weekday())
+		added := r * next.Sub(t).Hours() / 24
+		if !crossed && in.allowableGB != nil && total+added > float64(*in.allowableGB) && r > 0 {
+			crossed = true
+			at := t.Add(time.Duration((float64(*in.allowableGB) - total) / r * 24 * float64(time.Hour)))
+			capDate = &at
+		}
+		total += added
+		t = next
+	}
+	return total, capDate
+}
+
+func constantRate(r float64) func(time.Weekday) float64 {
+	return func(time.Weekday) float64 { return r }
+}
+
+// linearRate is the average daily usage since the start of the cycle.
+func linearRate(in *forecastInput) float64 {
+	elapsed := in.now.Sub(in.start).Hours() / 24
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(in.currentGB) / elapsed
+}
+
+// blendRate weighs the current cycle's rate by the fraction of the cycle elapsed and the previous
+// cycle's rate by the rest, so early projections aren't dominated by a day or two of usage. It
+// fails without a previous cycle.
+func blendRate(in *forecastInput, linear float64) (float64, bool) {
+	if in.previousGB == nil || in.previousDays <= 0 {
+		return 0, false
+	}
+	w := min(max(in.now.Sub(in.start).Hours()/in.end.Sub(in.start).Hours(), 0), 1)
+	return w*linear + (1-w)*float64(*in.previousGB)/in.previousDays, true
+}
+
+// ewmaRate is the exponentially weighted average of the daily totals, oldest first.
+func ewmaRate(daily []dailyTotal) (float64, bool) {
+	if len(daily) < forecastMinDays {
+		return 0, false
+	}
+	e := daily[0].gb
+	for _, d := range daily[1:] {
+		e = forecastEWMAAlpha*d.gb + (1-forecastEWMAAlpha)*e
+	}
+	return e, true
+}
+
+// seasonalRate scales the average of the last two weeks by how each day of the week compares to
+// the average day. It needs every day of the week in the history.
+func seasonalRate(daily []dailyTotal) func(time.Weekday) float64 {
+	var sums, counts [7]float64
+	var total float64
+	for _, d := range daily {
+		sums[d.day.Weekday()] += d.gb
+		counts[d.day.Weekday()]++
+		total += d.gb
+	}
+	for _, c := range counts {
+		if c == 0 {
+			return nil
+		}
+	}
+	mean := total / float64(len(daily))
+	recent := daily[max(len(daily)-14, 0):]
+	var base float64
+	for _, d := range recent {
+		base += d.gb
+	}
+	base /= float64(len(recent))
+	return func(w time.Weekday) float64 {
+		if mean == 0 {
+			return base
+		}
+		return base * (sums[w] / counts[w]) / mean
+	}
+}
+
+// dailyTotal is the usage of a full local day.
+type dailyTotal struct {
+	day time.Time
+	gb  float64
+}
+
+// dailyTotals returns the usage of every full day covered by the snapshots, oldest first. Days
+// before the first snapshot or after now are left out.
+func dailyTotals(snapshots []snapshot, now time.Time) []dailyTotal {
+	if len(snapshots) < 2 {
+		return nil
+	}
+	intervals := usageIntervals(snapshots)
+	first := snapshots[0].Time
+	y, m, d := first.Date()
+	var out []dailyTotal
+	for day := time.Date(y, m, d+1, 0, 0, 0, 0, first.Location()); ; day = day.AddDate(0, 0, 1) {
+		next := day.AddDate(0, 0, 1)
+		if next.After(now) {
+			break
+		}
+		out = append(out, dailyTotal{day: day, gb: float64(sumUsage(intervals, day, next))})
+	}
+	return out
+}
+
+func stddev(daily []dailyTotal) float64 {
+	if len(daily) < 2 {
+		return 0
+	}
+	var mean float64
+	for _, d := range daily {
+		mean += d.gb
+	}
+	mean /= float64(len(daily))
+	var v float64
+	for _, d := range daily {
+		v += (d.gb - mean) * (d.gb - mean)
+	}
+	return math.Sqrt(v / float64(len(daily)-1))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/csobrinho/xfinity-usage/xfinity"
+)
+
+func utcDay(month time.Month, day, hour int) time.Time {
+	return time.Date(2026, month, day, hour, 0, 0, 0, time.UTC)
+}
+
+// dailySnapshots returns a snapshot at every UTC midnight from the first day until now, with the
+// usage of each day given by gb.
+func dailySnapshots(first, now time.Time, gb func(day time.Time) float32) []snapshot {
+	var out []snapshot
+	var total float32
+	for t := first; !t.After(now); t = t.AddDate(0, 0, 1) {
+		if len(out) > 0 {
+			total += gb(t.AddDate(0, 0, -1))
+		}
+		out = append(out, testSnapshot(t, "2026-10-01", total))
+	}
+	return out
+}
+
+func TestForecastUsage(t *testing.T) {
+	allowable := 250
+	previousGB := float32(450)
+	base := forecastInput{
+		now:         utcDay(time.October, 11, 0),
+		currentGB:   100,
+		start:       utcDay(time.October, 1, 0),
+		end:         utcDay(time.October, 31, 0),
+		allowableGB: &allowable,
+	}
+	withInput := func(f func(in *forecastInput)) *forecastInput {
+		in := base
+		f(&in)
+		return &in
+	}
+	capDate := func(t time.Time) *time.Time { return &t }
+	weekend := func(day time.Time) float32 {
+		if w := day.Weekday(); w == time.Saturday || w == time.Sunday {
+			return 16
+		}
+		return 8
+	}
+	// Without enough history, the band is 1.645 * 50% of the linear rate of 10 GB/day * sqrt(20).
+	linearMargin := 1.645 * 5 * math.Sqrt(20)
+
+	tests := []struct {
+		name      string
+		model     forecastModel
+		in        *forecastInput
+		wantModel forecastModel
+		want      float64
+		// wantLow and wantHigh are only checked if set, otherwise the band must contain want.
+		wantLow, wantHigh float64
+		wantCap           *time.Time
+	}{
+		{
+			name:      "linear",
+			model:     forecastLinear,
+			in:        &base,
+			wantModel: forecastLinear,
+			want:      300,
+			wantLow:   300 - linearMargin,
+			wantHigh:  300 + linearMargin,
+			wantCap:   capDate(utcDay(time.October, 26, 0)),
+		},
+		{
+			name:      "linear unlimited",
+			model:     forecastLinear,
+			in:        withInput(func(in *forecastInput) { in.allowableGB = nil }),
+			wantModel: forecastLinear,
+			want:      300,
+		},
+		{
+			name:      "linear already over the allowance",
+			model:     forecastLinear,
+			in:        withInput(func(in *forecastInput) { in.currentGB = 260 }),
+			wantModel: forecastLinear,
+			want:      260 + 26*20,
+		},
+		{
+			// 0.5 days remain at 100 / 29.5 GB/day, so the band would dip below the current usage.
+			name:      "band never below the current usage",
+			model:     forecastLinear,
+			in:        withInput(func(in *forecastInput) { in.now = utcDay(time.October, 30, 12) }),
+			wantModel: forecastLinear,
+			want:      100 + 100/29.5*0.5,
+			wantLow:   100,
+			wantHigh:  100 + 100/29.5*0.5*(1+1.645*0.5/math.Sqrt(0.5)),
+		},
+		{
+			name:      "ewma without history",
+			model:     forecastEWMA,
+			in:        &base,
+			wantModel: forecastLinear,
+			want:      300,
+			wantCap:   capDate(utcDay(time.October, 26, 0)),
+		},
+		{
+			// A steady 8 GB/day has no deviation, so the band is empty.
+			name:  "ewma",
+			model: forecastEWMA,
+			in: withInput(func(in *forecastInput) {
+				in.snapshots = dailySnapshots(utcDay(time.October, 4, 0), in.now, func(time.Time) float32 { return 8 })
+			}),
+			wantModel: forecastEWMA,
+			want:      260,
+			wantLow:   260,
+			wantHigh:  260,
+			wantCap:   capDate(utcDay(time.October, 29, 18)),
+		},
+		{
+			name:  "seasonal without every day of the week",
+			model: forecastSeasonal,
+			in: withInput(func(in *forecastInput) {
+				in.snapshots = dailySnapshots(utcDay(time.October, 4, 0), in.now, weekend)
+			}),
+			wantModel: forecastLinear,
+			want:      300,
+			wantCap:   capDate(utcDay(time.October, 26, 0)),
+		},
+		{
+			// October 11 is a Sunday: 5 weekend days at 16 GB and 15 weekdays at 8 GB remain, and the
+			// allowance is crossed 6 GB into Sunday the 25th.
+			name:  "seasonal",
+			model: forecastSeasonal,
+			in: withInput(func(in *forecastInput) {
+				in.snapshots = dailySnapshots(utcDay(time.September, 26, 0), in.now, weekend)
+			}),
+			wantModel: forecastSeasonal,
+			want:      300,
+			wantCap:   capDate(utcDay(time.October, 25, 9)),
+		},
+		{
+			name:      "blend without a previous cycle",
+			model:     forecastBlend,
+			in:        &base,
+			wantModel: forecastLinear,
+			want:      300,
+			wantCap:   capDate(utcDay(time.October, 26, 0)),
+		},
+		{
+			// A third of the cycle elapsed: 1/3 of 10 GB/day and 2/3 of 450 / 30 GB/day, so the
+			// remaining 150 GB of the allowance last 11.25 days.
+			name:  "blend",
+			model: forecastBlend,
+			in: withInput(func(in *forecastInput) {
+				in.previousGB, in.previousDays = &previousGB, 30
+			}),
+			wantModel: forecastBlend,
+			want:      100 + (10.0/3+15*2.0/3)*20,
+			wantCap:   capDate(utcDay(time.October, 22, 6)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := forecastUsage(tt.model, tt.in)
+			if got.Model != tt.wantModel {
+				t.Errorf("model = %q, want %q", got.Model, tt.wantModel)
+			}
+			if math.Abs(float64(got.Estimated)-tt.want) > 0.01 {
+				t.Errorf("estimated = %v, want %v", got.Estimated, tt.want)
+			}
+			if tt.wantLow != 0 || tt.wantHigh != 0 {
+				if math.Abs(float64(got.Low)-tt.wantLow) > 0.01 || math.Abs(float64(got.High)-tt.wantHigh) > 0.01 {
+					t.Errorf("band = [%v, %v], want [%v, %v]", got.Low, got.High, tt.wantLow, tt.wantHigh)
+				}
+			} else if got.Low > got.Estimated || got.High < got.Estimated || got.Low < tt.in.currentGB {
+				t.Errorf("band [%v, %v] doesn't contain %v or is below the current usage", got.Low, got.High, got.Estimated)
+			}
+			switch {
+			case tt.wantCap == nil && got.CapDate != nil:
+				t.Errorf("cap date = %v, want none", got.CapDate)
+			case tt.wantCap != nil && (got.CapDate == nil || got.CapDate.Sub(*tt.wantCap).Abs() > time.Minute):
+				t.Errorf("cap date = %v, want %v", got.CapDate, tt.wantCap)
+			}
+		})
+	}
+}
+
+func TestNewForecastInput(t *testing.T) {
+	var u xfinity.Usage
+	err := json.Unmarshal([]byte(`{"data":{"accountByServiceAccountId":{"internet":{"usage":{"monthlyUsage":[
+		{"policy":"limited","startDate":"2026-10-01","endDate":"2026-10-31","currentUsage":{"value":100,"unit":"GB"},"allowableUsage":{"value":1.25,"unit":"TB"}},
+		{"policy":"limited","startDate":"2026-09-01","endDate":"2026-10-01","currentUsage":{"value":450,"unit":"GB"},"allowableUsage":{"value":1250,"unit":"GB"}}
+	]}}}}}`), &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := newForecastInput(&u, 100, nil, time.Date(2026, time.October, 11, 0, 0, 0, 0, time.Local))
+	if err != nil {
+		t.Fatalf("newForecastInput() = %v", err)
+	}
+	if want := time.Date(2026, time.October, 1, 0, 0, 0, 0, time.Local); !in.start.Equal(want) {
+		t.Errorf("start = %v, want %v", in.start, want)
+	}
+	if want := time.Date(2026, time.October, 31, 0, 0, 0, 0, time.Local); !in.end.Equal(want) {
+		t.Errorf("end = %v, want %v", in.end, want)
+	}
+	if in.allowableGB == nil || *in.allowableGB != 1250 {
+		t.Errorf("allowable = %v, want 1250", in.allowableGB)
+	}
+	// Both cycles are in local time, so the previous one spans exactly its local days, give or
+	// take a daylight saving change.
+	wantDays := time.Date(2026, time.October, 1, 0, 0, 0, 0, time.Local).Sub(time.Date(2026, time.September, 1, 0, 0, 0, 0, time.Local)).Hours() / 24
+	if in.previousGB == nil || *in.previousGB != 450 || in.previousDays != wantDays {
+		t.Errorf("previous = %v GB over %v days, want 450 over %v", in.previousGB, in.previousDays, wantDays)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/csobrinho/xfinity-usage/xfinity"
+	log "github.com/google/logger"
+)
+
+// snapshot is a single usage fetch recorded in the history store.
+type snapshot struct {
+	Time       time.Time            `json:"time"`
+	UsageGB    float32              `json:"usage_gb"`
+	Monthly    xfinity.UsageMonthly `json:"monthly"`
+	Attributes *UsageAttributes     `json:"attributes"`
+}
+
+// historyStore is an append-only JSON lines file of usage snapshots. Snapshots older than the
+// retention are pruned by pruneExpired.
+type historyStore struct {
+	path      string
+	retention time.Duration
+
+	mu sync.Mutex
+}
+
+// newHistoryStore returns the history store for the given path, or nil if history is disabled.
+func newHistoryStore(path string, retention time.Duration) *historyStore {
+	if path == "" {
+		return nil
+	}
+	return &historyStore{path: path, retention: retention}
+}
+
+// append records a snapshot.
+func (h *historyStore) append(s snapshot) error {
+	line, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open history: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to append to history: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close history: %w", err)
+	}
+	return nil
+}
+
+// pruneExpired removes the snapshots older than the retention once the oldest one expired more
+// than a day ago. Basing the schedule on the file itself, rather than on when this process last
+// pruned, keeps one-shot runs from rewriting the whole file every time.
+func (h *historyStore) pruneExpired(now time.Time) error {
+	if h.retention <= 0 {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	oldest, err := h.oldest()
+	if err != nil || oldest.IsZero() || now.Sub(oldest) < h.retention+24*time.Hour {
+		return err
+	}
+	return h.prune(now.Add(-h.retention))
+}
+
+// oldest returns the time of the first snapshot of the file, or zero if there is none.
+func (h *historyStore) oldest() (time.Time, error) {
+	f, err := os.Open(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read history: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var s snapshot
+		if json.Unmarshal(scanner.Bytes(), &s) == nil {
+			return s.Time, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, fmt.Errorf("failed to read history: %w", err)
+	}
+	return time.Time{}, nil
+}
+
+// query returns the snapshots taken in [from, to), oldest first. Zero times leave that end open.
+func (h *historyStore) query(from, to time.Time) ([]snapshot, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	all, err := h.read()
+	if err != nil {
+		return nil, err
+	}
+	var out []snapshot
+	for _, s := range all {
+		if (!from.IsZero() && s.Time.Before(from)) || (!to.IsZero() && !s.Time.Before(to)) {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// recent returns the snapshots stored within lookback of latest, followed by latest itself, which
+// isn't stored yet.
+func (h *historyStore) recent(latest snapshot, lookback time.Duration) ([]snapshot, error) {
+	snapshots, err := h.query(latest.Time.Add(-lookback), latest.Time)
+	if err != nil {
+		return nil, err
+	}
+	return append(snapshots, latest), nil
+}
+
+// read parses the whole file, skipping lines that can't be parsed (e.g. a write interrupted by a
+// crash) instead of failing.
+func (h *historyStore) read() ([]snapshot, error) {
+	data, err := os.ReadFile(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	var out []snapshot
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var s snapshot
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			log.Warningf("history: skipping invalid line %d: %v", n, err)
+			continue
+		}
+		out = append(out, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	return out, nil
+}
+
+// prune atomically rewrites the file without the snapshots taken before cutoff. It leaves the
+// file untouched if nothing expired.
+func (h *historyStore) prune(cutoff time.Time) error {
+	all, err := h.read()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	kept := 0
+	for _, s := range all {
+		if s.Time.Before(cutoff) {
+			continue
+		}
+		line, err := json.Marshal(s)
+		if err != nil {
+			return fmt.Errorf("failed to marshal snapshot: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		kept++
+	}
+	if kept == len(all) {
+		return nil
+	}
+	log.Infof("history: pruning %d snapshots older than %s", len(all)-kept, cutoff.Format(time.RFC3339))
+	return writeFileAtomic(h.path, buf.Bytes(), 0o600)
+}
+
+// serveHTTP returns the snapshots as a JSON array. The optional from and to query parameters
+// (RFC 3339) bound the time range.
+func (h *historyStore) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var from, to time.Time
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s: %v", name, err), http.StatusBadRequest)
+			return
+		}
+		*t = parsed
+	}
+	snapshots, err := h.query(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if snapshots == nil {
+		snapshots = []snapshot{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(snapshots); err != nil {
+		log.Warningf("history: failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// homeAssistantConfig holds the Home Assistant REST API sink settings.
+type homeAssistantConfig struct {
+	url   string
+	token string
+	// entityID is the object id of the usage sensor, sensor.<entityID>.
+	entityID string
+	// historyEntityID is the object id of the history sensor, disabled if empty.
+	historyEntityID string
+}
+
+var homeAssistantObjectIDRE = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// homeAssistantFor returns the Home Assistant sink settings of an account, whose sensors have the
+// account name appended to their ids.
+func (c config) homeAssistantFor(a accountConfig) homeAssistantConfig {
+	h := homeAssistantConfig{
+		url:             c.homeAssistantURL,
+		token:           c.homeAssistantToken,
+		entityID:        strings.TrimPrefix(c.homeAssistantEntityID, "sensor."),
+		historyEntityID: strings.TrimPrefix(c.homeAssistantHistoryEntityID, "sensor."),
+	}
+	if a.Name != "" {
+		// Account names may contain dashes, which object ids don't allow.
+		suffix := "_" + strings.ReplaceAll(a.Name, "-", "_")
+		h.entityID += suffix
+		if h.historyEntityID != "" {
+			h.historyEntityID += suffix
+		}
+	}
+	return h
+}
+
+// validateHomeAssistant reports the problems with the Home Assistant sink settings.
+func (c config) validateHomeAssistant() []error {
+	var errs []error
+	if c.homeAssistantURL == "" {
+		errs = append(errs, fmt.Errorf("missing --homeassistant_url"))
+	}
+	if c.homeAssistantToken == "" {
+		errs = append(errs, fmt.Errorf("missing --homeassistant_token"))
+	}
+	if id := strings.TrimPrefix(c.homeAssistantEntityID, "sensor."); !homeAssistantObjectIDRE.MatchString(id) {
+		errs = append(errs, fmt.Errorf("invalid --homeassistant_entity_id %q, expected lowercase letters, digits and underscores", c.homeAssistantEntityID))
+	}
+	if id := strings.TrimPrefix(c.homeAssistantHistoryEntityID, "sensor."); id != "" && !homeAssistantObjectIDRE.MatchString(id) {
+		errs = append(errs, fmt.Errorf("invalid --homeassistant_history_entity_id %q, expected lowercase letters, digits and underscores", c.homeAssistantHistoryEntityID))
+	}
+	return errs
+}
+
+// homeAssistantPublisher sets the state of the sensors through the Home Assistant REST API, for
+// setups without an MQTT broker. The sensors exist until Home Assistant restarts, when they are
+// recreated by the next fetch.
+type homeAssistantPublisher struct {
+	cfg    homeAssistantConfig
+	client *http.Client
+}
+
+func newHomeAssistantPublisher(cfg homeAssistantConfig, client *http.Client) *homeAssistantPublisher {
+	return &homeAssistantPublisher{cfg: cfg, client: client}
+}
+
+func (p *homeAssistantPublisher) name() string {
+	return sinkHomeAssistant
+}
+
+func (p *homeAssistantPublisher) close() {}
+
+// homeAssistantState is the body of a state update.
+type homeAssistantState struct {
+	State      string `json:"state"`
+	Attributes any    `json:"attributes"`
+}
+
+// publish sets the usage sensor, with the same attributes as the MQTT sink, and the history
+// sensor, whose state is the number of billing cycles.
+func (p *homeAssistantPublisher) publish(ctx context.Context, usage float32, attributes *UsageAttributes, history *UsageHistory) error {
+	if err := p.setState(ctx, p.cfg.entityID, homeAssistantState{State: fmt.Sprintf("%.2f", usage), Attributes: attributes}); err != nil {
+		return err
+	}
+	if p.cfg.historyEntityID == "" || history == nil {
+		return nil
+	}
+	return p.setState(ctx, p.cfg.historyEntityID, homeAssistantState{State: fmt.Sprint(len(history.Months)), Attributes: history})
+}
+
+// setState posts the state of sensor.<objectID>. Error responses are mapped to the metrics
+// categories that point at their likely cause. Setting a state is idempotent, so server errors and
+// 429s are retried by the shared client and, once it gives up, counted as homeassistant_publish.
+func (p *homeAssistantPublisher) setState(ctx context.Context, objectID string, state homeAssistantState) error {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal home assistant state: %w", err)
+	}
+	u := strings.TrimSuffix(p.cfg.url, "/") + "/api/states/sensor." + objectID
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create home assistant request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+p.cfg.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send home assistant request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("home assistant request for sensor.%s %w", objectID, &statusError{StatusCode: resp.StatusCode, Body: respBody})
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &sinkError{category: errorCategoryHomeAssistantAuth, err: err}
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed:
+		return &sinkError{category: errorCategoryHomeAssistantRequest, err: err}
+	}
+	return err
+}
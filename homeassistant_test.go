@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHomeAssistantPublisherPublish(t *testing.T) {
+	allowable := 1229
+	attributes := &UsageAttributes{Policy: "limited", UsageEstimated: 1100.5, AllowableUsage: &allowable}
+	history := &UsageHistory{Months: []UsageHistoryMonth{{Year: 2026, Month: 9}, {Year: 2026, Month: 10}}}
+
+	tests := []struct {
+		name      string
+		cfg       homeAssistantConfig
+		history   *UsageHistory
+		wantPaths []string
+	}{
+		{
+			name:      "usage",
+			cfg:       homeAssistantConfig{entityID: "xfinity_internet_usage"},
+			history:   history,
+			wantPaths: []string{"/api/states/sensor.xfinity_internet_usage"},
+		},
+		{
+			name:      "usage and history",
+			cfg:       homeAssistantConfig{entityID: "xfinity_internet_usage", historyEntityID: "xfinity_internet_history"},
+			history:   history,
+			wantPaths: []string{"/api/states/sensor.xfinity_internet_usage", "/api/states/sensor.xfinity_internet_history"},
+		},
+		{
+			name:      "no history",
+			cfg:       homeAssistantConfig{entityID: "xfinity_internet_usage", historyEntityID: "xfinity_internet_history"},
+			wantPaths: []string{"/api/states/sensor.xfinity_internet_usage"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPaths []string
+			var gotBodies []map[string]json.RawMessage
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer ha-token" || r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("got %s with authorization %q and content type %q, want a JSON POST with the bearer token",
+						r.Method, r.Header.Get("Authorization"), r.Header.Get("Content-Type"))
+				}
+				var body map[string]json.RawMessage
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("body: %v", err)
+				}
+				gotPaths, gotBodies = append(gotPaths, r.URL.Path), append(gotBodies, body)
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer srv.Close()
+
+			tt.cfg.url, tt.cfg.token = srv.URL+"/", "ha-token"
+			if err := newHomeAssistantPublisher(tt.cfg, srv.Client()).publish(context.Background(), 1000, attributes, tt.history); err != nil {
+				t.Fatalf("publish() = %v", err)
+			}
+			if strings.Join(gotPaths, " ") != strings.Join(tt.wantPaths, " ") {
+				t.Fatalf("paths = %v, want %v", gotPaths, tt.wantPaths)
+			}
+
+			wantAttributes, _ := json.Marshal(attributes)
+			if got := gotBodies[0]; string(got["state"]) != `"1000.00"` || string(got["attributes"]) != string(wantAttributes) {
+				t.Errorf("usage body = %s and %s, want the usage and attributes", got["state"], got["attributes"])
+			}
+			if len(gotBodies) > 1 {
+				wantHistory, _ := json.Marshal(history)
+				if got := gotBodies[1]; string(got["state"]) != `"2"` || string(got["attributes"]) != string(wantHistory) {
+					t.Errorf("history body = %s and %s, want the number of cycles and the history", got["state"], got["attributes"])
+				}
+			}
+		})
+	}
+}
+
+func TestHomeAssistantPublisherStatusError(t *testing.T) {
+	tests := []struct {
+		status       int
+		wantCategory errorCategory
+	}{
+		{status: http.StatusUnauthorized, wantCategory: errorCategoryHomeAssistantAuth},
+		{status: http.StatusForbidden, wantCategory: errorCategoryHomeAssistantAuth},
+		{status: http.StatusBadRequest, wantCategory: errorCategoryHomeAssistantRequest},
+		{status: http.StatusNotFound, wantCategory: errorCategoryHomeAssistantRequest},
+		{status: http.StatusMethodNotAllowed, wantCategory: errorCategoryHomeAssistantRequest},
+		// Server errors are retried by the shared client and then counted as publish errors.
+		{status: http.StatusInternalServerError, wantCategory: "homeassistant_publish"},
+		{status: http.StatusServiceUnavailable, wantCategory: "homeassistant_publish"},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				http.Error(w, `{"message":"rejected"}`, tt.status)
+			}))
+			defer srv.Close()
+
+			cfg := homeAssistantConfig{url: srv.URL, token: "ha-token", entityID: "xfinity_internet_usage"}
+			err := newHomeAssistantPublisher(cfg, srv.Client()).publish(context.Background(), 1, &UsageAttributes{}, nil)
+			if err == nil || !strings.Contains(err.Error(), "sensor.xfinity_internet_usage") || !strings.Contains(err.Error(), "rejected") {
+				t.Fatalf("publish() = %v, want a status error with the sensor and the response body", err)
+			}
+			if got := publishErrorCategory(sinkHomeAssistant, err); got != tt.wantCategory {
+				t.Errorf("category = %q, want %q", got, tt.wantCategory)
+			}
+		})
+	}
+}
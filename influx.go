@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// influxConfig holds the InfluxDB sink settings. Writes go to the v2 /api/v2/write endpoint if a
+// bucket is set, or to the v1 /write endpoint with a database.
+type influxConfig struct {
+	url         string
+	measurement string
+	tags        map[string]string
+
+	// InfluxDB v2.
+	bucket string
+	org    string
+	token  string
+
+	// InfluxDB v1.
+	database        string
+	retentionPolicy string
+	username        string
+	password        string
+}
+
+// influxFor returns the InfluxDB sink settings of an account, whose points are tagged with the
+// account name.
+func (c config) influxFor(a accountConfig) (influxConfig, error) {
+	tags, err := parseInfluxTags(c.influxTags)
+	if err != nil {
+		return influxConfig{}, err
+	}
+	if a.Name != "" {
+		tags["account"] = a.Name
+	}
+	return influxConfig{
+		url:             c.influxURL,
+		measurement:     c.influxMeasurement,
+		tags:            tags,
+		bucket:          c.influxBucket,
+		org:             c.influxOrg,
+		token:           c.influxToken,
+		database:        c.influxDatabase,
+		retentionPolicy: c.influxRetentionPolicy,
+		username:        c.influxUsername,
+		password:        c.influxPassword,
+	}, nil
+}
+
+// validateInflux reports the problems with the InfluxDB sink settings.
+func (c config) validateInflux() []error {
+	var errs []error
+	if c.influxURL == "" {
+		errs = append(errs, fmt.Errorf("missing --influxdb_url"))
+	}
+	if c.influxMeasurement == "" {
+		errs = append(errs, fmt.Errorf("missing --influxdb_measurement"))
+	} else if strings.ContainsFunc(c.influxMeasurement, unicode.IsControl) {
+		errs = append(errs, fmt.Errorf("invalid --influxdb_measurement %q, line protocol can't contain control characters", c.influxMeasurement))
+	}
+	switch {
+	case c.influxBucket == "" && c.influxDatabase == "":
+		errs = append(errs, fmt.Errorf("missing --influxdb_bucket (v2) or --influxdb_database (v1)"))
+	case c.influxBucket != "" && c.influxDatabase != "":
+		errs = append(errs, fmt.Errorf("--influxdb_bucket and --influxdb_database are mutually exclusive"))
+	case c.influxBucket != "" && c.influxOrg == "":
+		errs = append(errs, fmt.Errorf("--influxdb_bucket requires --influxdb_org"))
+	}
+	if _, err := parseInfluxTags(c.influxTags); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// parseInfluxTags parses comma separated key=value tags. Line protocol can't carry control
+// characters like newlines, so they are rejected.
+func parseInfluxTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("invalid --influxdb_tags entry %q, expected key=value", kv)
+		}
+		if strings.ContainsFunc(kv, unicode.IsControl) {
+			return nil, fmt.Errorf("invalid --influxdb_tags entry %q, line protocol can't contain control characters", kv)
+		}
+		tags[k] = v
+	}
+	return tags, nil
+}
+
+// influxPublisher writes the usage to InfluxDB as line protocol.
+type influxPublisher struct {
+	cfg    influxConfig
+	client *http.Client
+}
+
+func newInfluxPublisher(cfg influxConfig, client *http.Client) *influxPublisher {
+	return &influxPublisher{cfg: cfg, client: client}
+}
+
+func (p *influxPublisher) name() string {
+	return sinkInfluxDB
+}
+
+func (p *influxPublisher) close() {}
+
+// publish writes a point with the current, allowable, remaining, estimated and daily average usage.
+func (p *influxPublisher) publish(ctx context.Context, usage float32, attributes *UsageAttributes, _ *UsageHistory) error {
+	line := p.cfg.line(usage, attributes, time.Now())
+	req, err := p.cfg.writeRequest(ctx, line)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send influxdb request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("influxdb request %w", &statusError{StatusCode: resp.StatusCode, Body: body})
+	}
+	return nil
+}
+
+// writeRequest returns the write request of the v2 or v1 endpoint, with second precision.
+func (c influxConfig) writeRequest(ctx context.Context, line []byte) (*http.Request, error) {
+	q := url.Values{}
+	q.Set("precision", "s")
+	endpoint := "/write"
+	if c.bucket != "" {
+		endpoint = "/api/v2/write"
+		q.Set("org", c.org)
+		q.Set("bucket", c.bucket)
+	} else {
+		q.Set("db", c.database)
+		if c.retentionPolicy != "" {
+			q.Set("rp", c.retentionPolicy)
+		}
+	}
+	u := strings.TrimSuffix(c.url, "/") + endpoint + "?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(line))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create influxdb request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case c.token != "":
+		req.Header.Set("Authorization", "Token "+c.token)
+	case c.username != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return req, nil
+}
+
+// line encodes the usage as a line protocol point, tagged with the configured tags and the policy,
+// unless a configured tag is already named policy. Fields that don't apply to the plan, like the
+// allowance of an unlimited policy, are left out.
+func (c influxConfig) line(usage float32, attributes *UsageAttributes, now time.Time) []byte {
+	tags := maps.Clone(c.tags)
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	if _, ok := tags["policy"]; !ok && attributes.Policy != "" {
+		tags["policy"] = attributes.Policy
+	}
+	fields := [][2]string{
+		{"usage", formatInfluxFloat(usage)},
+		{"usage_estimated", formatInfluxFloat(attributes.UsageEstimated)},
+		{"usage_daily_average", formatInfluxFloat(attributes.UsageDailyAverage)},
+	}
+	if attributes.AllowableUsage != nil {
+		fields = append(fields, [2]string{"allowable_usage", formatInfluxFloat(float32(*attributes.AllowableUsage))})
+	}
+	if attributes.UsageRemaining != nil {
+		fields = append(fields, [2]string{"usage_remaining", formatInfluxFloat(float32(*attributes.UsageRemaining))})
+	}
+
+	var b bytes.Buffer
+	b.WriteString(influxEscape(c.measurement, ", "))
+	for _, k := range slices.Sorted(maps.Keys(tags)) {
+		fmt.Fprintf(&b, ",%s=%s", influxEscape(k, ",= "), influxEscape(tags[k], ",= "))
+	}
+	for i, f := range fields {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		fmt.Fprintf(&b, "%s%s=%s", sep, influxEscape(f[0], ",= "), f[1])
+	}
+	fmt.Fprintf(&b, " %d\n", now.Unix())
+	return b.Bytes()
+}
+
+// formatInfluxFloat formats a float field. Numbers without a suffix are floats in line protocol, so
+// whole values keep the same field type.
+func formatInfluxFloat(v float32) string {
+	return strconv.FormatFloat(float64(v), 'f', -1, 32)
+}
+
+// influxEscape escapes the characters of s that are special in its line protocol position, as well
+// as backslashes.
+func influxEscape(s, special string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfluxPublisherPublish(t *testing.T) {
+	allowable, remaining := 1229, 229
+	limited := &UsageAttributes{
+		Policy:            "limited",
+		UsageEstimated:    1100.5,
+		UsageDailyAverage: 33,
+		AllowableUsage:    &allowable,
+		UsageRemaining:    &remaining,
+	}
+	unlimited := &UsageAttributes{Policy: "unlimited", UsageEstimated: 1500, UsageDailyAverage: 50}
+
+	tests := []struct {
+		name       string
+		cfg        influxConfig
+		attributes *UsageAttributes
+		wantPath   string
+		wantQuery  url.Values
+		wantAuth   string
+		// wantLine is the point without its timestamp.
+		wantLine string
+	}{
+		{
+			name: "v2",
+			cfg: influxConfig{
+				measurement: "xfinity usage,total",
+				tags:        map[string]string{"site": `home, main=1`, "account": "cabin"},
+				bucket:      "home",
+				org:         "my org",
+				token:       "influx-token",
+			},
+			attributes: limited,
+			wantPath:   "/api/v2/write",
+			wantQuery:  url.Values{"bucket": {"home"}, "org": {"my org"}, "precision": {"s"}},
+			wantAuth:   "Token influx-token",
+			wantLine: `xfinity\ usage\,total,account=cabin,policy=limited,site=home\,\ main\=1 ` +
+				`usage=1000,usage_estimated=1100.5,usage_daily_average=33,allowable_usage=1229,usage_remaining=229`,
+		},
+		{
+			name: "v1",
+			cfg: influxConfig{
+				measurement:     "xfinity_usage",
+				tags:            map[string]string{"path": `C:\data`, "note": "two words"},
+				database:        "home",
+				retentionPolicy: "autogen",
+				username:        "user",
+				password:        "secret",
+			},
+			attributes: unlimited,
+			wantPath:   "/write",
+			wantQuery:  url.Values{"db": {"home"}, "rp": {"autogen"}, "precision": {"s"}},
+			wantAuth:   "Basic dXNlcjpzZWNyZXQ=",
+			wantLine:   `xfinity_usage,note=two\ words,path=C:\\data,policy=unlimited usage=1000,usage_estimated=1500,usage_daily_average=50`,
+		},
+		{
+			name: "configured policy tag",
+			cfg: influxConfig{
+				measurement: "xfinity_usage",
+				tags:        map[string]string{"policy": "custom"},
+				database:    "home",
+			},
+			attributes: limited,
+			wantPath:   "/write",
+			wantQuery:  url.Values{"db": {"home"}, "precision": {"s"}},
+			wantLine: `xfinity_usage,policy=custom ` +
+				`usage=1000,usage_estimated=1100.5,usage_daily_average=33,allowable_usage=1229,usage_remaining=229`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotMethod, gotPath, gotAuth, gotContentType string
+			var gotQuery url.Values
+			var gotBody []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotMethod, gotPath, gotQuery = r.Method, r.URL.Path, r.URL.Query()
+				gotAuth, gotContentType = r.Header.Get("Authorization"), r.Header.Get("Content-Type")
+				gotBody, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+
+			tt.cfg.url = srv.URL + "/"
+			start := time.Now().Unix()
+			if err := newInfluxPublisher(tt.cfg, srv.Client()).publish(context.Background(), 1000, tt.attributes, nil); err != nil {
+				t.Fatalf("publish() = %v", err)
+			}
+
+			if gotMethod != http.MethodPost {
+				t.Errorf("method = %q, want POST", gotMethod)
+			}
+			if gotPath != tt.wantPath {
+				t.Errorf("path = %q, want %q", gotPath, tt.wantPath)
+			}
+			if gotQuery.Encode() != tt.wantQuery.Encode() {
+				t.Errorf("query = %q, want %q", gotQuery.Encode(), tt.wantQuery.Encode())
+			}
+			if gotAuth != tt.wantAuth {
+				t.Errorf("authorization = %q, want %q", gotAuth, tt.wantAuth)
+			}
+			if want := "text/plain; charset=utf-8"; gotContentType != want {
+				t.Errorf("content type = %q, want %q", gotContentType, want)
+			}
+
+			line, ok := strings.CutSuffix(string(gotBody), "\n")
+			i := strings.LastIndexByte(line, ' ')
+			if !ok || i < 0 || strings.Contains(line, "\n") {
+				t.Fatalf("body = %q, want a single point", gotBody)
+			}
+			if line[:i] != tt.wantLine {
+				t.Errorf("point = %s\nwant    %s", line[:i], tt.wantLine)
+			}
+			if ts, err := strconv.ParseInt(line[i+1:], 10, 64); err != nil || ts < start || ts > time.Now().Unix() {
+				t.Errorf("timestamp = %q, want the current time in seconds", line[i+1:])
+			}
+		})
+	}
+}
+
+func TestInfluxPublisherStatusError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"code":"unauthorized"}`, http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	cfg := influxConfig{url: srv.URL, measurement: "xfinity_usage", bucket: "home", org: "home", token: "bad"}
+	err := newInfluxPublisher(cfg, srv.Client()).publish(context.Background(), 1, &UsageAttributes{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "401") || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("publish() = %v, want a 401 status error with the response body", err)
+	}
+}
+
+func TestValidateInflux(t *testing.T) {
+	valid := config{influxURL: "http://influx:8086", influxMeasurement: "xfinity_usage", influxDatabase: "home"}
+	tests := []struct {
+		name    string
+		cfg     func(c *config)
+		wantErr string
+	}{
+		{name: "valid", cfg: func(c *config) { c.influxTags = "site=home, room = office " }},
+		{name: "missing value", cfg: func(c *config) { c.influxTags = "site=" }, wantErr: "expected key=value"},
+		{name: "newline in a tag", cfg: func(c *config) { c.influxTags = "note=two\nlines" }, wantErr: "control characters"},
+		{name: "tab in a key", cfg: func(c *config) { c.influxTags = "no\tte=x" }, wantErr: "control characters"},
+		{name: "newline in the measurement", cfg: func(c *config) { c.influxMeasurement = "xfinity\r\nusage" }, wantErr: "control characters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.cfg(&c)
+			err := errors.Join(c.validateInflux()...)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateInflux() = %v, want no errors", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateInflux() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
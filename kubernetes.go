@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/google/logger"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// serviceAccountDir is where Kubernetes mounts the pod's service account credentials.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesSecretSink writes the rotated refresh token back to a Kubernetes Secret through the
+// in-cluster API, so the next pod started from the same Secret picks it up.
+type kubernetesSecretSink struct {
+	client    *retryablehttp.Client
+	apiURL    string
+	tokenFile string
+	namespace string
+	name      string
+	key       string
+}
+
+// newKubernetesSecretSink returns a sink for the in-cluster API server using the pod's service
+// account. If namespace is empty, the pod's own namespace is used.
+func newKubernetesSecretSink(name, namespace, key string) (*kubernetesSecretSink, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set, not running in a cluster?")
+	}
+	return newKubernetesSecretSinkForAPI("https://"+net.JoinHostPort(host, port), serviceAccountDir, name, namespace, key)
+}
+
+// newKubernetesSecretSinkForAPI returns a sink for an arbitrary API server, reading the bearer
+// token, CA bundle and default namespace from saDir.
+func newKubernetesSecretSinkForAPI(apiURL, saDir, name, namespace, key string) (*kubernetesSecretSink, error) {
+	if namespace == "" {
+		ns, err := os.ReadFile(filepath.Join(saDir, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	client := newHTTPClient()
+	client.Logger = &logger{prefix: "kubernetes: "}
+	ca, err := os.ReadFile(filepath.Join(saDir, "ca.crt"))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		log.Warningf("kubernetes: no service account CA found in %s, using system roots", saDir)
+	case err != nil:
+		return nil, fmt.Errorf("failed to read service account CA: %w", err)
+	default:
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("failed to parse service account CA")
+		}
+		transport, ok := client.HTTPClient.Transport.(*http.Transport)
+		if !ok {
+			return nil, fmt.Errorf("unexpected http transport %T", client.HTTPClient.Transport)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &kubernetesSecretSink{
+		client:    client,
+		apiURL:    strings.TrimSuffix(apiURL, "/"),
+		tokenFile: filepath.Join(saDir, "token"),
+		namespace: namespace,
+		name:      name,
+		key:       key,
+	}, nil
+}
+
+// save patches the refresh token key of the Secret, leaving any other keys untouched.
+func (s *kubernetesSecretSink) save(ctx context.Context, t *storedToken) error {
+	// Projected service account tokens are rotated by the kubelet, so always read the latest one.
+	bearer, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	patch, err := json.Marshal(map[string]map[string]string{
+		"data": {s.key: base64.StdEncoding.EncodeToString([]byte(t.RefreshToken))},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal secret patch: %w", err)
+	}
+
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/secrets/%s", s.apiURL, url.PathEscape(s.namespace), url.PathEscape(s.name))
+	req, err := retryablehttp.NewRequestWithContext(ctx, "PATCH", u, bytes.NewReader(patch))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(bearer)))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to patch secret %s/%s with status %d: %s", s.namespace, s.name, resp.StatusCode, body)
+	}
+	log.Infof("kubernetes: updated %s in secret %s/%s", s.key, s.namespace, s.name)
+	return nil
+}
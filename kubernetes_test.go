@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeServiceAccount writes the service account files of a pod talking to srv.
+func fakeServiceAccount(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	dir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	for name, content := range map[string]string{
+		"ca.crt":    string(ca),
+		"token":     "sa-token\n",
+		"namespace": "home\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestKubernetesSecretSinkSave(t *testing.T) {
+	var gotPath, gotMethod, gotContentType, gotAuth string
+	var gotBody map[string]map[string]string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotMethod = r.URL.Path, r.Method
+		gotContentType, gotAuth = r.Header.Get("Content-Type"), r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &gotBody); err != nil {
+			t.Errorf("failed to parse patch %q: %v", body, err)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	sink, err := newKubernetesSecretSinkForAPI(srv.URL, fakeServiceAccount(t, srv), "xfinity", "", "refresh_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.save(context.Background(), &storedToken{RefreshToken: "new-token"}); err != nil {
+		t.Fatalf("save() = %v", err)
+	}
+
+	if want := "/api/v1/namespaces/home/secrets/xfinity"; gotPath != want {
+		t.Errorf("path = %q, want %q", gotPath, want)
+	}
+	if gotMethod != http.MethodPatch {
+		t.Errorf("method = %q, want PATCH", gotMethod)
+	}
+	if want := "application/merge-patch+json"; gotContentType != want {
+		t.Errorf("content type = %q, want %q", gotContentType, want)
+	}
+	if want := "Bearer sa-token"; gotAuth != want {
+		t.Errorf("authorization = %q, want %q", gotAuth, want)
+	}
+	// base64("new-token")
+	if got, want := gotBody["data"]["refresh_token"], "bmV3LXRva2Vu"; got != want || len(gotBody["data"]) != 1 {
+		t.Errorf("patch data = %v, want only refresh_token=%q", gotBody["data"], want)
+	}
+}
+
+func TestKubernetesSecretSinkSaveErrors(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusNotFound} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			calls := 0
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.WriteHeader(status)
+				w.Write([]byte(`{"kind":"Status","reason":"denied"}`))
+			}))
+			defer srv.Close()
+
+			sink, err := newKubernetesSecretSinkForAPI(srv.URL, fakeServiceAccount(t, srv), "xfinity", "other", "refresh_token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sink.save(context.Background(), &storedToken{RefreshToken: "new-token"})
+			if err == nil {
+				t.Fatal("save() succeeded, want an error")
+			}
+			if !strings.Contains(err.Error(), "other/xfinity") || !strings.Contains(err.Error(), "denied") {
+				t.Errorf("save() = %v, want the secret and the response body", err)
+			}
+			// Client errors are not retried.
+			if calls != 1 {
+				t.Errorf("got %d requests, want 1", calls)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,40 +11,133 @@ import (
 	"os"
 	"runtime"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/csobrinho/xfinity-usage/xfinity"
 	log "github.com/google/logger"
 	"github.com/hashicorp/go-retryablehttp"
 )
 
-const (
-	tokenURL  = "https://xerxes-sub.xerxessecure.com/xerxes-ctrl/oauth/token"
-	usageURL  = "https://gw.api.dh.comcast.com/galileo/graphql"
-	usageBody = `{"operationName":"InternetDataUsage","variables":{},"query":"query InternetDataUsage { accountByServiceAccountId { internet { plan { name downloadSpeed { unit value } uploadSpeed { unit value } } usage { inPaidOverage courtesy { totalAllowableCourtesy usedCourtesy remainingCourtesy } monthlyUsage { policy month year startDate endDate daysRemaining currentUsage { value unit } allowableUsage { value unit } overage overageCharge maximumOverageCharge courtesyCredit } } } } }"}`
-)
-
 func init() {
 	flag.DurationVar(&cfg.timeout, "timeout", 90*time.Second, "timeout in seconds")
-	flag.StringVar(&cfg.clientID, "client_id", "xfinity-android-application", "OAuth client id")
+	flag.StringVar(&cfg.clientID, "client_id", xfinity.DefaultClientID, "OAuth client id")
 	flag.StringVar(&cfg.mqttClientID, "mqtt_client_id", "xfinity-usage-go", "MQTT client id")
 	flag.StringVar(&cfg.mqttStateTopic, "mqtt_state_topic", "homeassistant/sensor/xfinity_internet/state", "MQTT state topic")
 	flag.StringVar(&cfg.mqttAttributesTopic, "mqtt_attributes_topic", "homeassistant/sensor/xfinity_internet/attributes", "MQTT attributes topic")
+	flag.StringVar(&cfg.mqttHistoryTopic, "mqtt_history_topic", "homeassistant/sensor/xfinity_internet/history", "MQTT topic for the usage of every billing cycle, empty to disable")
+	flag.StringVar(&cfg.mqttAvailability, "mqtt_availability_topic", "homeassistant/sensor/xfinity_internet/availability", "MQTT availability topic, empty to disable")
+	flag.BoolVar(&cfg.mqttDiscovery, "mqtt_discovery", boolGetenv(envVar("mqtt_discovery", "MQTT_DISCOVERY"), false), "Publish Home Assistant MQTT discovery configs")
+	flag.StringVar(&cfg.mqttDiscoveryPrefix, "mqtt_discovery_prefix", "homeassistant", "Home Assistant MQTT discovery prefix")
+	flag.StringVar(&cfg.mqttNodeID, "mqtt_node_id", "xfinity_internet", "Home Assistant MQTT discovery node id")
 
-	flag.IntVar(&cfg.verbose, "v", intGetenv("VERBOSE", 1), "Logger verbose level")
-	flag.StringVar(&cfg.clientSecret, "client_secret", os.Getenv("CLIENT_SECRET"), "OAuth client secret")
-	flag.StringVar(&cfg.refreshToken, "refresh_token", os.Getenv("REFRESH_TOKEN"), "OAuth refresh token")
-	flag.StringVar(&cfg.accessToken, "access_token", os.Getenv("ACCESS_TOKEN"), "OAuth access token")
-	flag.StringVar(&cfg.idToken, "id_token", os.Getenv("ID_TOKEN"), "OAuth id token")
-	flag.StringVar(&cfg.applicationID, "application_id", os.Getenv("APPLICATION_ID"), "OAuth application id")
-	flag.StringVar(&cfg.mqttURL, "mqtt_url", os.Getenv("MQTT_URL"), "MQTT url")
-	flag.StringVar(&cfg.mqttUsername, "mqtt_username", os.Getenv("MQTT_USERNAME"), "MQTT username")
-	flag.StringVar(&cfg.mqttPassword, "mqtt_password", os.Getenv("MQTT_PASSWORD"), "MQTT password")
+	flag.IntVar(&cfg.verbose, "v", intGetenv(envVar("v", "VERBOSE"), 1), "Logger verbose level")
+	flag.StringVar(&cfg.clientSecret, "client_secret", os.Getenv(envVar("client_secret", "CLIENT_SECRET")), "OAuth client secret")
+	flag.StringVar(&cfg.refreshToken, "refresh_token", os.Getenv(envVar("refresh_token", "REFRESH_TOKEN")), "OAuth refresh token")
+	flag.StringVar(&cfg.kubernetesSecret, "kubernetes_secret", os.Getenv(envVar("kubernetes_secret", "KUBERNETES_SECRET")), "Kubernetes Secret to update with rotated refresh tokens")
+	flag.StringVar(&cfg.kubernetesSecretKey, "kubernetes_secret_key", "REFRESH_TOKEN", "Key of the refresh token in the Kubernetes Secret")
+	flag.StringVar(&cfg.kubernetesNamespace, "kubernetes_namespace", os.Getenv(envVar("kubernetes_namespace", "KUBERNETES_NAMESPACE")), "Namespace of the Kubernetes Secret, defaults to the pod namespace")
+	flag.DurationVar(&cfg.tokenExpiryMargin, "token_expiry_margin", durationGetenv(envVar("token_expiry_margin", "TOKEN_EXPIRY_MARGIN"), 5*time.Minute), "Refresh cached access tokens when they expire within this margin")
+	flag.StringVar(&cfg.tokenStore, "token_store", os.Getenv(envVar("token_store", "TOKEN_STORE")), "File used to persist refreshed OAuth tokens, takes precedence over --refresh_token")
+	flag.StringVar(&cfg.accessToken, "access_token", os.Getenv(envVar("access_token", "ACCESS_TOKEN")), "OAuth access token")
+	flag.StringVar(&cfg.idToken, "id_token", os.Getenv(envVar("id_token", "ID_TOKEN")), "OAuth id token")
+	flag.StringVar(&cfg.applicationID, "application_id", os.Getenv(envVar("application_id", "APPLICATION_ID")), "OAuth application id")
+	flag.StringVar(&cfg.sinkList, "sinks", stringGetenv(envVar("sinks", "SINKS"), sinkMQTT), "Comma separated output sinks to publish the usage to: mqtt, influxdb, homeassistant, or none to only export metrics")
+	flag.StringVar(&cfg.influxURL, "influxdb_url", os.Getenv(envVar("influxdb_url", "INFLUXDB_URL")), "InfluxDB url, e.g. http://localhost:8086")
+	flag.StringVar(&cfg.influxMeasurement, "influxdb_measurement", stringGetenv(envVar("influxdb_measurement", "INFLUXDB_MEASUREMENT"), "xfinity_usage"), "InfluxDB measurement")
+	flag.StringVar(&cfg.influxTags, "influxdb_tags", os.Getenv(envVar("influxdb_tags", "INFLUXDB_TAGS")), "Comma separated key=value tags added to the InfluxDB points")
+	flag.StringVar(&cfg.influxBucket, "influxdb_bucket", os.Getenv(envVar("influxdb_bucket", "INFLUXDB_BUCKET")), "InfluxDB v2 bucket")
+	flag.StringVar(&cfg.influxOrg, "influxdb_org", os.Getenv(envVar("influxdb_org", "INFLUXDB_ORG")), "InfluxDB v2 organization")
+	flag.StringVar(&cfg.influxToken, "influxdb_token", os.Getenv(envVar("influxdb_token", "INFLUXDB_TOKEN")), "InfluxDB v2 API token")
+	flag.StringVar(&cfg.influxDatabase, "influxdb_database", os.Getenv(envVar("influxdb_database", "INFLUXDB_DATABASE")), "InfluxDB v1 database")
+	flag.StringVar(&cfg.influxRetentionPolicy, "influxdb_retention_policy", os.Getenv(envVar("influxdb_retention_policy", "INFLUXDB_RETENTION_POLICY")), "InfluxDB v1 retention policy, empty for the default one")
+	flag.StringVar(&cfg.influxUsername, "influxdb_username", os.Getenv(envVar("influxdb_username", "INFLUXDB_USERNAME")), "InfluxDB v1 username")
+	flag.StringVar(&cfg.influxPassword, "influxdb_password", os.Getenv(envVar("influxdb_password", "INFLUXDB_PASSWORD")), "InfluxDB v1 password")
+	flag.StringVar(&cfg.homeAssistantURL, "homeassistant_url", os.Getenv(envVar("homeassistant_url", "HOMEASSISTANT_URL")), "Home Assistant url, e.g. http://homeassistant.local:8123")
+	flag.StringVar(&cfg.homeAssistantToken, "homeassistant_token", os.Getenv(envVar("homeassistant_token", "HOMEASSISTANT_TOKEN")), "Home Assistant long-lived access token")
+	flag.StringVar(&cfg.homeAssistantEntityID, "homeassistant_entity_id", stringGetenv(envVar("homeassistant_entity_id", "HOMEASSISTANT_ENTITY_ID"), "xfinity_internet_usage"), "Object id of the Home Assistant usage sensor, sensor.<id>")
+	flag.StringVar(&cfg.homeAssistantHistoryEntityID, "homeassistant_history_entity_id", os.Getenv(envVar("homeassistant_history_entity_id", "HOMEASSISTANT_HISTORY_ENTITY_ID")), "Object id of the Home Assistant history sensor, empty to disable")
+	flag.StringVar(&cfg.mqttURL, "mqtt_url", os.Getenv(envVar("mqtt_url", "MQTT_URL")), "MQTT url")
+	flag.StringVar(&cfg.mqttUsername, "mqtt_username", os.Getenv(envVar("mqtt_username", "MQTT_USERNAME")), "MQTT username")
+	flag.StringVar(&cfg.mqttPassword, "mqtt_password", os.Getenv(envVar("mqtt_password", "MQTT_PASSWORD")), "MQTT password")
+	flag.StringVar(&cfg.mqttCAFile, "mqtt_ca_file", os.Getenv(envVar("mqtt_ca_file", "MQTT_CA_FILE")), "MQTT TLS CA bundle (PEM)")
+	flag.StringVar(&cfg.mqttCertFile, "mqtt_cert_file", os.Getenv(envVar("mqtt_cert_file", "MQTT_CERT_FILE")), "MQTT TLS client certificate (PEM)")
+	flag.StringVar(&cfg.mqttKeyFile, "mqtt_key_file", os.Getenv(envVar("mqtt_key_file", "MQTT_KEY_FILE")), "MQTT TLS client key (PEM)")
+	flag.StringVar(&cfg.mqttServerName, "mqtt_server_name", os.Getenv(envVar("mqtt_server_name", "MQTT_SERVER_NAME")), "MQTT TLS server name override")
+	flag.BoolVar(&cfg.mqttInsecure, "mqtt_insecure_skip_verify", boolGetenv(envVar("mqtt_insecure_skip_verify", "MQTT_INSECURE_SKIP_VERIFY"), false), "Skip MQTT TLS certificate verification (insecure)")
 	flag.StringVar(&cfg.prometheusJob, "prometheus_job", "xfinity-usage", "Prometheus job name")
-	flag.StringVar(&cfg.prometheusEndpoint, "prometheus_endpoint", os.Getenv("PROMETHEUS_ENDPOINT"), "Prometheus Pushgateway endpoint")
-	flag.StringVar(&cfg.query, "query", os.Getenv("QUERY"), "GraphQL query to test")
+	flag.StringVar(&cfg.prometheusEndpoint, "prometheus_endpoint", os.Getenv(envVar("prometheus_endpoint", "PROMETHEUS_ENDPOINT")), "Prometheus Pushgateway endpoint")
+	flag.StringVar(&cfg.listenAddr, "listen_addr", os.Getenv(envVar("listen_addr", "LISTEN_ADDR")), "Address to serve /metrics, /healthz and /readyz on, e.g. :9090")
+	flag.DurationVar(&cfg.readyMaxAge, "ready_max_age", durationGetenv(envVar("ready_max_age", "READY_MAX_AGE"), 2*time.Hour), "Maximum age of the last successful fetch for /readyz to report ready, 0 to disable")
+	flag.StringVar(&cfg.historyPath, "history_file", os.Getenv(envVar("history_file", "HISTORY_FILE")), "JSON lines file to record every usage snapshot in, empty to disable")
+	flag.DurationVar(&cfg.historyRetention, "history_retention", durationGetenv(envVar("history_retention", "HISTORY_RETENTION"), 90*24*time.Hour), "How long to keep usage snapshots, 0 to keep them forever")
+	flag.StringVar(&cfg.forecastModel, "forecast_model", stringGetenv(envVar("forecast_model", "FORECAST_MODEL"), string(forecastLinear)), "End of cycle forecast model: linear, ewma, seasonal or blend. ewma and seasonal learn from the snapshots of --history_file, which they require")
+	flag.IntVar(&cfg.overageBlockGB, "overage_block_gb", intGetenv(envVar("overage_block_gb", "OVERAGE_BLOCK_GB"), 50), "Size of each overage block in GB")
+	flag.IntVar(&cfg.overageBlockPrice, "overage_block_price", intGetenv(envVar("overage_block_price", "OVERAGE_BLOCK_PRICE"), 10), "Price of each overage block in dollars")
+	flag.IntVar(&cfg.overageMaxCharge, "overage_max_charge", intGetenv(envVar("overage_max_charge", "OVERAGE_MAX_CHARGE"), 0), "Maximum overage charge per billing cycle in dollars, 0 to use the one reported by the API")
+	flag.StringVar(&cfg.alertRules, "alert_rules", stringGetenv(envVar("alert_rules", "ALERT_RULES"), "usage:80,usage:90,usage:100,estimated:100"), "Comma separated alert rules, <usage|estimated>:<percent of the allowance>")
+	flag.StringVar(&cfg.alertStateFile, "alert_state_file", os.Getenv(envVar("alert_state_file", "ALERT_STATE_FILE")), "File used to persist the alerts already sent in the billing cycle")
+	flag.StringVar(&cfg.alertWebhookURL, "alert_webhook_url", os.Getenv(envVar("alert_webhook_url", "ALERT_WEBHOOK_URL")), "URL to POST alerts to as JSON")
+	flag.StringVar(&cfg.alertNtfyURL, "alert_ntfy_url", os.Getenv(envVar("alert_ntfy_url", "ALERT_NTFY_URL")), "ntfy topic URL to publish alerts to, e.g. https://ntfy.sh/my-topic")
+	flag.StringVar(&cfg.alertNtfyToken, "alert_ntfy_token", os.Getenv(envVar("alert_ntfy_token", "ALERT_NTFY_TOKEN")), "ntfy access token")
+	flag.StringVar(&cfg.alertGotifyURL, "alert_gotify_url", os.Getenv(envVar("alert_gotify_url", "ALERT_GOTIFY_URL")), "Gotify server URL to send alerts to")
+	flag.StringVar(&cfg.alertGotifyToken, "alert_gotify_token", os.Getenv(envVar("alert_gotify_token", "ALERT_GOTIFY_TOKEN")), "Gotify application token")
+	flag.StringVar(&cfg.alertSlackURL, "alert_slack_url", os.Getenv(envVar("alert_slack_url", "ALERT_SLACK_URL")), "Slack or Discord incoming webhook URL to send alerts to")
+	flag.StringVar(&cfg.alertSMTPAddr, "alert_smtp_addr", os.Getenv(envVar("alert_smtp_addr", "ALERT_SMTP_ADDR")), "SMTP server host:port to email alerts through")
+	flag.StringVar(&cfg.alertSMTPUsername, "alert_smtp_username", os.Getenv(envVar("alert_smtp_username", "ALERT_SMTP_USERNAME")), "SMTP username")
+	flag.StringVar(&cfg.alertSMTPPassword, "alert_smtp_password", os.Getenv(envVar("alert_smtp_password", "ALERT_SMTP_PASSWORD")), "SMTP password")
+	flag.StringVar(&cfg.alertSMTPFrom, "alert_smtp_from", os.Getenv(envVar("alert_smtp_from", "ALERT_SMTP_FROM")), "Sender address of alert emails")
+	flag.StringVar(&cfg.alertSMTPTo, "alert_smtp_to", os.Getenv(envVar("alert_smtp_to", "ALERT_SMTP_TO")), "Comma separated recipients of alert emails")
+	flag.StringVar(&cfg.query, "query", os.Getenv(envVar("query", "QUERY")), "GraphQL query to test")
+	flag.BoolVar(&cfg.dryRun, "dry_run", boolGetenv(envVar("dry_run", "DRY_RUN"), false), "Print the MQTT messages instead of publishing them, implied by --output")
+	flag.StringVar(&cfg.output, "output", os.Getenv(envVar("output", "OUTPUT")), "Format of the dry run output: json, table or yaml")
+	flag.DurationVar(&cfg.interval, "interval", durationGetenv(envVar("interval", "INTERVAL"), 0), "Run as a daemon, fetching usage at this interval")
+	flag.StringVar(&cfg.schedule, "schedule", os.Getenv(envVar("schedule", "SCHEDULE")), "Run as a daemon, fetching usage on this cron schedule")
+	flag.DurationVar(&cfg.jitter, "jitter", durationGetenv(envVar("jitter", "JITTER"), 30*time.Second), "Maximum random delay added to each daemon run")
+	flag.DurationVar(&cfg.retryBackoff, "retry_backoff", durationGetenv(envVar("retry_backoff", "RETRY_BACKOFF"), time.Minute), "Initial daemon retry delay after a failure, doubled on each consecutive failure")
+
+	flag.IntVar(&cfg.accountConcurrency, "account_concurrency", intGetenv(envVar("account_concurrency", "ACCOUNT_CONCURRENCY"), 2), "Maximum number of accounts fetched concurrently")
+	flag.StringVar(&cfg.configFile, "config", os.Getenv(envVar("config", "CONFIG")), "YAML or TOML config file, overridden by environment variables and flags")
+
+	secretFileVar(&cfg.clientSecret, "client_secret")
+	secretFileVar(&cfg.refreshToken, "refresh_token")
+	secretFileVar(&cfg.accessToken, "access_token")
+	secretFileVar(&cfg.idToken, "id_token")
+	secretFileVar(&cfg.mqttPassword, "mqtt_password")
+	secretFileVar(&cfg.influxToken, "influxdb_token")
+	secretFileVar(&cfg.influxPassword, "influxdb_password")
+	secretFileVar(&cfg.homeAssistantToken, "homeassistant_token")
+	secretFileVar(&cfg.alertWebhookURL, "alert_webhook_url")
+	secretFileVar(&cfg.alertNtfyToken, "alert_ntfy_token")
+	secretFileVar(&cfg.alertGotifyToken, "alert_gotify_token")
+	secretFileVar(&cfg.alertSlackURL, "alert_slack_url")
+	secretFileVar(&cfg.alertSMTPPassword, "alert_smtp_password")
+}
+
+// loadConfig applies the config file and reads the secret files once the flags are parsed.
+// explicit holds the names of the flags set on the command line.
+func loadConfig(explicit map[string]bool) error {
+	if cfg.configFile != "" {
+		if err := loadConfigFile(cfg.configFile, explicit); err != nil {
+			return err
+		}
+	}
+	return loadSecretFiles()
+}
+
+// flagEnv maps the flags that default to an environment variable to that variable.
+var flagEnv = map[string]string{}
 
-	flag.Parse()
+// envVar records that the flag defaults to the environment variable name and returns name.
+func envVar(flagName, name string) string {
+	flagEnv[flagName] = name
+	return name
+}
+
+func stringGetenv(name, defaultVal string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return defaultVal
 }
 
 func intGetenv(name string, defaultVal int) int {
@@ -59,6 +153,32 @@ func intGetenv(name string, defaultVal int) int {
 	return iv
 }
 
+func boolGetenv(name string, defaultVal bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return defaultVal
+	}
+	bv, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warningf("main: unsupported %s value %q, defaulting to %t", name, v, defaultVal)
+		return defaultVal
+	}
+	return bv
+}
+
+func durationGetenv(name string, defaultVal time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return defaultVal
+	}
+	dv, err := time.ParseDuration(v)
+	if err != nil {
+		log.Warningf("main: unsupported %s value %q, defaulting to %s", name, v, defaultVal)
+		return defaultVal
+	}
+	return dv
+}
+
 func retryPolicyWithMetrics(ctx context.Context, resp *http.Response, err error) (bool, error) {
 	shouldRetry, retryErr := retryablehttp.DefaultRetryPolicy(ctx, resp, err)
 	if shouldRetry {
@@ -77,29 +197,13 @@ func retryPolicyWithMetrics(ctx context.Context, resp *http.Response, err error)
 	return shouldRetry, retryErr
 }
 
-func getTokens(ctx context.Context, client *retryablehttp.Client) (string, string, error) {
-	// Short-circuit if access token is already provided.
-	if cfg.accessToken != "" && cfg.idToken != "" {
-		log.Info("main: using provided access token")
-		return cfg.accessToken, cfg.idToken, nil
-	}
-
-	// Refresh OAuth token.
-	tokenStart := time.Now()
-	token, extra, err := tokenRequest(ctx, client, cfg.refreshToken, cfg.clientID, cfg.clientSecret, cfg.applicationID)
-	tokenRefreshDuration.Observe(time.Since(tokenStart).Seconds())
-	if err != nil {
-		recordError(errorCategoryTokenRefresh)
-		return "", "", fmt.Errorf("failed to access token: %w", err)
-	}
-	log.Infof("main: token expiry: %d seconds", token.ExpiresIn)
-	log.V(2).Infof("main: access token: %s", token.AccessToken)
-	log.V(2).Infof("main: id token:     %s", extra.IDToken)
-	return token.AccessToken, extra.IDToken, nil
-}
-
-func actionRunQuery(ctx context.Context, client *retryablehttp.Client, accessToken, idToken, graphql string) error {
-	body, err := query(ctx, client, accessToken, idToken, usageURL, "POST", strings.NewReader(graphql), usageExtraHeaders)
+// actionRunQuery runs a GraphQL request and writes the pretty printed response to w.
+func actionRunQuery(ctx context.Context, api *xfinity.Client, tokens *tokenManager, graphql string, w io.Writer) error {
+	var body []byte
+	err := tokens.do(func() (err error) {
+		body, err = api.Query(ctx, []byte(graphql))
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -111,119 +215,422 @@ func actionRunQuery(ctx context.Context, client *retryablehttp.Client, accessTok
 	if err != nil {
 		return fmt.Errorf("failed to format JSON: %w", err)
 	}
-	log.Info(string(pretty))
-
-	return nil
+	_, err = fmt.Fprintln(w, string(pretty))
+	return err
 }
 
-func actionFetchUsageData(ctx context.Context, client *retryablehttp.Client, accessToken, idToken string) error {
-	usageStart := time.Now()
-	u, err := internetDataUsageRequest(ctx, client, accessToken, idToken)
-	usageFetchDuration.Observe(time.Since(usageStart).Seconds())
+func (a *app) actionFetchUsageData(ctx context.Context) error {
+	var u *xfinity.Usage
+	err := a.tokens.do(func() (err error) {
+		usageStart := time.Now()
+		u, err = a.api.InternetDataUsage(ctx)
+		usageFetchDuration.Observe(time.Since(usageStart).Seconds())
+		return err
+	})
+	if errors.Is(err, errTokenRefresh) {
+		return err
+	}
 	if err != nil {
-		recordError(errorCategoryUsageFetch)
+		recordError(errorCategoryUsageFetch, a.account.Name)
 		return fmt.Errorf("failed to get internet usage: %w", err)
 	}
 
 	// Parse and validate usage data.
 	if u.Data == nil || u.Data.Account == nil || u.Data.Account.Internet == nil ||
 		u.Data.Account.Internet.Usage == nil || len(u.Data.Account.Internet.Usage.MonthlyUsage) == 0 {
-		recordError(errorCategoryUsageParse)
+		recordError(errorCategoryUsageParse, a.account.Name)
 		return fmt.Errorf("failed to process internet usage")
 	}
 
 	monthlyUsage := u.Data.Account.Internet.Usage.MonthlyUsage[0]
 	cur, err := monthlyUsage.CurrentUsage.GB()
 	if err != nil {
-		recordError(errorCategoryUsageParse)
+		recordError(errorCategoryUsageParse, a.account.Name)
 		return fmt.Errorf("failed to get internet usage in gb: %w", err)
 	}
 
 	log.Infof("main: usage %7.2f GB", cur)
-	if monthlyUsage.Policy == PolicyUnlimited {
+	if monthlyUsage.Policy == xfinity.PolicyUnlimited {
 		log.Infof("main: allowed %s policy", monthlyUsage.Policy)
 	} else if allowed, err := monthlyUsage.AllowableUsage.GB(); err == nil {
 		log.Infof("main: allowed %7.2f GB", allowed)
 	}
 
 	// Build attributes for Home Assistant.
-	attributes, err := u.ToAttributes()
+	attributes, err := newUsageAttributes(u)
 	if err != nil {
-		recordError(errorCategoryUsageParse)
+		recordError(errorCategoryUsageParse, a.account.Name)
 		return fmt.Errorf("failed to build usage attributes: %w", err)
 	}
 
-	// Publish to MQTT.
-	mqttStart := time.Now()
-	if err := mqttPublish(ctx, cfg.mqttURL, cfg.mqttUsername, cfg.mqttPassword, cfg.mqttClientID, cfg.mqttStateTopic, cfg.mqttAttributesTopic, cur, attributes); err != nil {
-		mqttPublishDuration.Observe(time.Since(mqttStart).Seconds())
-		recordError(errorCategoryMQTTPublish)
-		return fmt.Errorf("failed to publish to mqtt: %w", err)
+	history, err := newUsageHistory(u)
+	if err != nil {
+		recordError(errorCategoryUsageParse, a.account.Name)
+		return fmt.Errorf("failed to build usage history: %w", err)
 	}
-	mqttPublishDuration.Observe(time.Since(mqttStart).Seconds())
+	recordHistory(a.account.Name, history)
 
-	// Record success metrics.
-	recordSuccess()
-	return nil
-}
+	// Derive the recent deltas and the forecast, then record the snapshot before publishing, so
+	// it is kept even if publishing fails.
+	now := time.Now()
+	snap := snapshot{Time: now, UsageGB: cur, Monthly: monthlyUsage, Attributes: attributes}
+	var recent []snapshot
+	if a.history != nil {
+		if recent, err = a.history.recent(snap, max(deltasLookback, forecastLookback)); err != nil {
+			recordError(errorCategoryHistoryStore, a.account.Name)
+			log.Errorf("main: failed to read usage history: %v", err)
+		} else {
+			deltas := computeDeltas(recent, now)
+			attributes.setDeltas(deltas)
+			recordDeltas(a.account.Name, deltas)
+		}
+	}
+	if in, err := newForecastInput(u, cur, recent, now); err != nil {
+		log.Warningf("main: failed to forecast usage: %v", err)
+	} else {
+		fc := forecastUsage(a.forecastModel, in)
+		attributes.setForecast(fc)
+	}
+	if c := a.overage.estimate(u, attributes, cur); c != nil {
+		attributes.setOverageCost(*c)
+	}
+	recordUsage(a.account.Name, u, attributes, cur)
 
-func run(ctx context.Context) error {
-	// Increment total runs counter.
-	runsTotal.Inc()
+	// A dry run prints the messages instead, without sending alerts or recording the snapshot.
+	if format := cfg.outputFormat(); format != "" {
+		r, err := newDryRunReport(a.account.Name, a.publishers, cur, attributes, history)
+		if err != nil {
+			return err
+		}
+		if err := r.write(os.Stdout, format); err != nil {
+			return fmt.Errorf("failed to print dry run: %w", err)
+		}
+		return nil
+	}
 
-	// Validate configuration.
-	if err := cfg.validate(); err != nil {
-		recordError(errorCategoryConfigValidation)
-		return fmt.Errorf("failed to validate config: %w", err)
+	if a.alerter != nil {
+		a.alerter.evaluate(ctx, attributes, cur)
 	}
+	if a.history != nil {
+		if err := a.history.append(snap); err != nil {
+			recordError(errorCategoryHistoryStore, a.account.Name)
+			log.Errorf("main: failed to record usage history: %v", err)
+		} else if err := a.history.pruneExpired(now); err != nil {
+			recordError(errorCategoryHistoryStore, a.account.Name)
+			log.Errorf("main: failed to prune usage history: %v", err)
+		}
+	}
+
+	// Publish to every sink.
+	return publishAll(ctx, a.account.Name, a.publishers, cur, attributes, history)
+}
 
+func newHTTPClient() *retryablehttp.Client {
 	client := retryablehttp.NewClient()
 	client.RetryMax = 3
 	client.CheckRetry = retryPolicyWithMetrics
 	client.Logger = &logger{prefix: "http: "}
+	return client
+}
+
+func validateConfig() error {
+	if err := cfg.validate(); err != nil {
+		recordError(errorCategoryConfigValidation, "")
+		return fmt.Errorf("failed to validate config: %w", err)
+	}
+	return nil
+}
 
-	// Get access token (either from config or refresh).
-	accessToken, idToken, err := getTokens(ctx, client)
+// validateAuthConfig validates the options needed to call the API.
+func validateAuthConfig() error {
+	if err := errors.Join(cfg.validateAuth()...); err != nil {
+		recordError(errorCategoryConfigValidation, "")
+		return fmt.Errorf("failed to validate config: %w", err)
+	}
+	return nil
+}
+
+// app fetches and publishes the usage of one account, keeping its clients across daemon runs.
+type app struct {
+	account    accountConfig
+	client     *retryablehttp.Client
+	api        *xfinity.Client
+	tokens     *tokenManager
+	publishers []publisher
+	history    *historyStore
+	ready      *readiness
+
+	forecastModel forecastModel
+	overage       overageCostModel
+	alerter       *alerter
+}
+
+// newAccountClient creates the API client and token manager of an account.
+// ctx is used by the token refreshes, which are bounded by the timeout of the HTTP client instead.
+func newAccountClient(ctx context.Context, account accountConfig, client *retryablehttp.Client) (*xfinity.Client, *tokenManager, error) {
+	var sinks []tokenSink
+	if account.KubernetesSecret != "" {
+		sink, err := newKubernetesSecretSink(account.KubernetesSecret, cfg.kubernetesNamespace, cfg.kubernetesSecretKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create kubernetes secret sink: %w", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	tokens, err := newTokenManager(account.Name, account.RefreshToken, cfg.accessToken, cfg.idToken, newTokenStore(account.TokenStore), sinks...)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	httpClient := client.StandardClient()
+	httpClient.Timeout = cfg.timeout
+	api := xfinity.New(
+		xfinity.WithHTTPClient(httpClient),
+		xfinity.WithClientCredentials(cfg.clientID, account.ClientSecret),
+		xfinity.WithApplicationID(cfg.applicationID),
+		xfinity.WithTokenSource(tokens),
+	)
+	tokens.bind(ctx, api, cfg.tokenExpiryMargin)
+	return api, tokens, nil
+}
 
-	if cfg.query != "" {
-		log.Info("main: running test query")
-		return actionRunQuery(ctx, client, accessToken, idToken, cfg.query)
+func newApp(ctx context.Context, account accountConfig, ready *readiness, history *historyStore) (*app, error) {
+	client := newHTTPClient()
+	api, tokens, err := newAccountClient(ctx, account, client)
+	if err != nil {
+		return nil, err
+	}
+	ready.setTokens(account.Name, tokens)
+	model, err := parseForecastModel(cfg.forecastModel)
+	if err != nil {
+		return nil, err
+	}
+	alerter, err := newAccountAlerter(account)
+	if err != nil {
+		return nil, err
+	}
+	publishers, err := newPublishers(account, client.StandardClient())
+	if err != nil {
+		return nil, err
 	}
-	return actionFetchUsageData(ctx, client, accessToken, idToken)
+	return &app{
+		account:    account,
+		client:     client,
+		api:        api,
+		tokens:     tokens,
+		publishers: publishers,
+		history:    history,
+		ready:      ready,
+
+		forecastModel: model,
+		overage:       cfg.overage(),
+		alerter:       alerter,
+	}, nil
 }
 
-func main() {
-	log.Init("xfinity-usage", cfg.verbose > 0, false, io.Discard)
-	log.SetLevel(log.Level(cfg.verbose))
-	defer log.Close()
+// newAccountAlerter creates the alerter of an account, or nil if alerting is disabled.
+func newAccountAlerter(account accountConfig) (*alerter, error) {
+	rules, err := parseAlertRules(cfg.alertRules)
+	if err != nil {
+		return nil, err
+	}
+	return newAlerter(account.Name, rules, cfg.notifiers(&http.Client{Timeout: notifyTimeout}), account.AlertStateFile)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
-	defer cancel()
+// reload returns a copy of the app with the reloaded config of its account. The API client and
+// tokens are only recreated if the credentials changed, and the publishers and alerter if told
+// so, so the app keeps its cached tokens and connections otherwise. A recreated alerter keeps the
+// alerts already sent. The app itself is left untouched.
+func (a *app) reload(ctx context.Context, account accountConfig, publishers, notifiers bool) (*app, error) {
+	next := *a
+	next.account = account
+	if a.credentialsChanged(account) {
+		api, tokens, err := newAccountClient(ctx, account, a.client)
+		if err != nil {
+			return nil, err
+		}
+		next.api, next.tokens = api, tokens
+	}
+	if notifiers {
+		alerter, err := newAccountAlerter(account)
+		if err != nil {
+			return nil, err
+		}
+		if alerter != nil && a.alerter != nil {
+			alerter.state = a.alerter.state
+		}
+		next.alerter = alerter
+	}
+	// The publishers are created last, so they never need to be closed on errors.
+	if publishers {
+		p, err := newPublishers(account, a.client.StandardClient())
+		if err != nil {
+			return nil, err
+		}
+		next.publishers = p
+	}
+	return &next, nil
+}
 
-	setBuildInfo(version, runtime.Version())
+// credentialsChanged reports whether the account needs new tokens. A refresh token the token
+// manager already uses, e.g. one it rotated and wrote back to a mounted Kubernetes Secret, isn't a
+// change.
+func (a *app) credentialsChanged(account accountConfig) bool {
+	if account.ClientSecret != a.account.ClientSecret || cfg.accessToken != a.tokens.accessToken || cfg.idToken != a.tokens.idToken {
+		return true
+	}
+	return account.RefreshToken != a.account.RefreshToken && account.RefreshToken != a.tokens.state().RefreshToken
+}
+
+// newApps creates the app of every account. histories maps the account names to their history
+// store. ctx must outlive the runs, see newAccountClient.
+func newApps(ctx context.Context, ready *readiness, histories map[string]*historyStore) ([]*app, error) {
+	var apps []*app
+	for _, account := range cfg.accountList() {
+		a, err := newApp(ctx, account, ready, histories[account.Name])
+		if err != nil {
+			closeApps(apps)
+			return nil, accountError(account.Name, err)
+		}
+		apps = append(apps, a)
+	}
+	return apps, nil
+}
+
+// newHistoryStores returns the history store of every account that has one enabled.
+func newHistoryStores() map[string]*historyStore {
+	histories := map[string]*historyStore{}
+	for _, account := range cfg.accountList() {
+		if h := newHistoryStore(account.HistoryFile, cfg.historyRetention); h != nil {
+			histories[account.Name] = h
+		}
+	}
+	return histories
+}
+
+func closeApps(apps []*app) {
+	for _, a := range apps {
+		a.close()
+	}
+}
+
+func (a *app) close() {
+	for _, p := range a.publishers {
+		p.close()
+	}
+}
+
+func (a *app) wrap(err error) error {
+	return accountError(a.account.Name, err)
+}
+
+// accountError adds the account name to errors of a multi account config.
+func accountError(account string, err error) error {
+	if account == "" {
+		return err
+	}
+	return fmt.Errorf("account %s: %w", account, err)
+}
+
+// run performs a single fetch cycle.
+func (a *app) run(ctx context.Context) error {
+	if err := a.actionFetchUsageData(ctx); err != nil {
+		return err
+	}
+	a.ready.success(a.account.Name, time.Now())
+	return nil
+}
+
+// observeRun records the run metrics around fn and pushes them to the Pushgateway, if configured.
+func observeRun(ctx context.Context, fn func(context.Context) error) error {
+	// Increment total runs counter.
+	runsTotal.Inc()
 	recordRunStart()
 
 	start := time.Now()
-	err := run(ctx)
+	err := fn(ctx)
 	executionDuration.Observe(time.Since(start).Seconds())
 
+	// The run metrics cover every account at once, so a cycle is only successful if all of them are.
 	if err != nil {
 		recordFailure()
+	} else {
+		recordSuccess()
 	}
 
-	if cfg.prometheusEndpoint != "" {
+	if cfg.prometheusEndpoint != "" && cfg.outputFormat() == "" {
 		if perr := pushMetrics(ctx, cfg.prometheusEndpoint, cfg.prometheusJob); perr != nil {
 			log.Errorf("main: failed to push metrics: %v", perr)
 		} else {
 			log.Info("main: metrics pushed successfully")
 		}
 	}
+	return err
+}
+
+// runOnce validates the configuration and performs a single fetch cycle for every account.
+func runOnce(ctx context.Context, ready *readiness, histories map[string]*historyStore) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	return observeRun(ctx, func(ctx context.Context) error {
+		if err := validateConfig(); err != nil {
+			return err
+		}
+		apps, err := newApps(ctx, ready, histories)
+		if err != nil {
+			return err
+		}
+		defer closeApps(apps)
+		return runAccounts(ctx, apps, func(ctx context.Context, a *app) error {
+			err := a.run(ctx)
+			if cfg.outputFormat() != "" {
+				return err
+			}
+
+			// Use a fresh context so the status still goes out if the run timed out.
+			statusCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+			defer cancel()
+			for _, p := range a.publishers {
+				if sp, ok := p.(statusPublisher); ok {
+					if serr := sp.publishStatus(statusCtx, err == nil); serr != nil {
+						log.Warningf("main: failed to publish availability to %s: %v", p.name(), serr)
+					}
+				}
+			}
+			return err
+		})
+	})
+}
+
+// runFetch fetches and publishes the usage of every account, once or on the daemon schedule.
+func runFetch(ctx context.Context) error {
+	setBuildInfo(version, runtime.Version())
+
+	ready := &readiness{maxAge: cfg.readyMaxAge}
+	histories := newHistoryStores()
+	if cfg.listenAddr != "" {
+		srv, err := startServer(cfg.listenAddr, ready, histories)
+		if err != nil {
+			return err
+		}
+		defer shutdownServer(srv)
+	}
 
+	var err error
+	if cfg.daemon() {
+		log.Info("main: starting in daemon mode")
+		if err = validateConfig(); err == nil {
+			err = runDaemon(ctx, ready, histories)
+		}
+	} else {
+		err = runOnce(ctx, ready, histories)
+	}
 	if err != nil {
-		log.Fatalf("main: %v", err)
+		return err
 	}
 	log.Info("main: all done ✅")
+	return nil
+}
+
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
 }
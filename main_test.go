@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	log "github.com/google/logger"
+)
+
+func TestMain(m *testing.M) {
+	log.Init("xfinity-usage-test", false, false, io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestAppReload(t *testing.T) {
+	saveConfig(t)
+	cfg.accessToken, cfg.idToken, cfg.tokenStore, cfg.kubernetesSecret = "", "", "", ""
+	cfg.alertRules, cfg.alertWebhookURL, cfg.alertStateFile = "usage:80", "http://127.0.0.1/hook", ""
+	cfg.sinkList, cfg.homeAssistantURL, cfg.homeAssistantToken = sinkHomeAssistant, "http://127.0.0.1:8123", "ha"
+	account := accountConfig{ClientSecret: "secret", RefreshToken: "refresh-0"}
+	newTestApp := func(t *testing.T) *app {
+		t.Helper()
+		a, err := newApp(context.Background(), account, &readiness{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The token manager rotated the refresh token and sent an alert.
+		a.tokens.current.RefreshToken = "refresh-1"
+		a.alerter.state = alertState{Cycle: "2026-10-01", Fired: []string{"usage:80"}}
+		return a
+	}
+	with := func(f func(a *accountConfig)) accountConfig {
+		a := account
+		f(&a)
+		return a
+	}
+
+	tests := []struct {
+		name                        string
+		account                     accountConfig
+		publishers, notifiers       bool
+		wantTokens                  bool
+		wantRefreshToken            string
+		wantPublishers, wantAlerter bool
+	}{
+		{
+			name:             "rotated refresh token written back",
+			account:          with(func(a *accountConfig) { a.RefreshToken = "refresh-1" }),
+			wantRefreshToken: "refresh-1",
+		},
+		{
+			name:             "new refresh token",
+			account:          with(func(a *accountConfig) { a.RefreshToken = "refresh-9" }),
+			wantTokens:       true,
+			wantRefreshToken: "refresh-9",
+		},
+		{
+			name:             "new client secret",
+			account:          with(func(a *accountConfig) { a.ClientSecret = "new secret" }),
+			wantTokens:       true,
+			wantRefreshToken: "refresh-0",
+		},
+		{
+			name:             "sink secret",
+			account:          account,
+			publishers:       true,
+			wantRefreshToken: "refresh-1",
+			wantPublishers:   true,
+		},
+		{
+			name:             "notifier secret",
+			account:          account,
+			notifiers:        true,
+			wantRefreshToken: "refresh-1",
+			wantAlerter:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t)
+			got, err := a.reload(context.Background(), tt.account, tt.publishers, tt.notifiers)
+			if err != nil {
+				t.Fatalf("reload() = %v", err)
+			}
+			if got.account != tt.account {
+				t.Errorf("account = %+v, want %+v", got.account, tt.account)
+			}
+			if (got.tokens != a.tokens) != tt.wantTokens || (got.api != a.api) != tt.wantTokens {
+				t.Errorf("recreated tokens = %t, want %t", got.tokens != a.tokens, tt.wantTokens)
+			}
+			if rt := got.tokens.state().RefreshToken; rt != tt.wantRefreshToken {
+				t.Errorf("refresh token = %q, want %q", rt, tt.wantRefreshToken)
+			}
+			if (&got.publishers[0] != &a.publishers[0]) != tt.wantPublishers {
+				t.Errorf("recreated publishers = %t, want %t", &got.publishers[0] != &a.publishers[0], tt.wantPublishers)
+			}
+			if (got.alerter != a.alerter) != tt.wantAlerter {
+				t.Errorf("recreated alerter = %t, want %t", got.alerter != a.alerter, tt.wantAlerter)
+			}
+			if !reflect.DeepEqual(got.alerter.state, a.alerter.state) {
+				t.Errorf("alert state = %+v, want %+v", got.alerter.state, a.alerter.state)
+			}
+			if got.client != a.client || got.history != a.history {
+				t.Error("the HTTP client and history weren't kept")
+			}
+		})
+	}
+}
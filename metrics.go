@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/csobrinho/xfinity-usage/xfinity"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/push"
 )
@@ -26,11 +27,11 @@ var (
 		Help: "Total number of successful xfinity-usage runs",
 	})
 
-	// Counter for errors by category.
+	// Counter for errors by category and, for publish errors, sink.
 	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "xfinity_usage_errors_total",
-		Help: "Total number of errors by category",
-	}, []string{"category"})
+		Help: "Total number of errors by category, account and sink",
+	}, []string{"category", "account", "sink"})
 
 	// Gauge for last successful run timestamp.
 	lastSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -59,8 +60,8 @@ var (
 	// Gauge for last error timestamp by category (use changes() to count occurrences).
 	lastErrorTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "xfinity_usage_last_error_timestamp",
-		Help: "Timestamp of the last error by category",
-	}, []string{"category"})
+		Help: "Timestamp of the last error by category and account",
+	}, []string{"category", "account"})
 
 	// Histogram for execution duration.
 	executionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
@@ -83,25 +84,168 @@ var (
 		Buckets: prometheus.DefBuckets,
 	})
 
-	// Histogram for MQTT publish duration.
+	// Histogram for MQTT publish duration, kept alongside publishDuration for existing dashboards.
 	mqttPublishDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "xfinity_usage_mqtt_publish_duration_seconds",
 		Help:    "MQTT publish operation duration in seconds",
 		Buckets: prometheus.DefBuckets,
 	})
 
+	// Histogram for publish duration by sink.
+	publishDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "xfinity_usage_publish_duration_seconds",
+		Help:    "Publish operation duration in seconds by sink",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"sink"})
+
+	// Counter for successful publishes by sink.
+	publishSuccessTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "xfinity_usage_publish_success_total",
+		Help: "Total number of successful publishes by sink",
+	}, []string{"sink"})
+
 	// Counter for retries by host, method, and status code.
 	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "xfinity_usage_retries_total",
 		Help: "Total number of retries by host, method, and status code",
 	}, []string{"host", "method", "status_code"})
 
+	// Counter for alerts sent by notifier.
+	alertsSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "xfinity_usage_alerts_sent_total",
+		Help: "Total number of alerts sent by account and notifier",
+	}, []string{"account", "notifier"})
+
 	// Gauge for build info.
 	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "xfinity_usage_build_info",
 		Help: "Build information (version, go_version)",
 	}, []string{"version", "go_version"})
 
+	// Gauges for the usage data itself, labelled by account, policy and plan name.
+	usageLabels = []string{"account", "policy", "plan"}
+
+	usageCurrentGB = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_current_gb",
+		Help: "Current usage in the billing cycle in GB",
+	}, usageLabels)
+
+	usageAllowableGB = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_allowable_gb",
+		Help: "Allowable usage in the billing cycle in GB",
+	}, usageLabels)
+
+	usageRemainingGB = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_remaining_gb",
+		Help: "Remaining usage before reaching the allowance in GB",
+	}, usageLabels)
+
+	usageEstimatedGB = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_estimated_gb",
+		Help: "Estimated usage at the end of the billing cycle in GB",
+	}, usageLabels)
+
+	usageEstimatedLowGB = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_estimated_low_gb",
+		Help: "Lower bound of the 90% confidence band of the usage at the end of the billing cycle in GB",
+	}, usageLabels)
+
+	usageEstimatedHighGB = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_estimated_high_gb",
+		Help: "Upper bound of the 90% confidence band of the usage at the end of the billing cycle in GB",
+	}, usageLabels)
+
+	usageProjectedCapTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_projected_cap_timestamp_seconds",
+		Help: "Start of the day the allowance is projected to be exceeded, if within the billing cycle",
+	}, usageLabels)
+
+	usageDailyAverageGB = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_daily_average_gb",
+		Help: "Average daily usage in the billing cycle in GB",
+	}, usageLabels)
+
+	usageDaysRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_days_remaining",
+		Help: "Days remaining in the billing cycle",
+	}, usageLabels)
+
+	usageOverageCharge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_overage_charge_dollars",
+		Help: "Overage charge in the billing cycle in dollars",
+	}, usageLabels)
+
+	usageOverageProjectedCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_overage_projected_cost_dollars",
+		Help: "Projected overage charge at the end of the billing cycle in dollars",
+	}, usageLabels)
+
+	usageOverageNextBlockCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_overage_next_block_cost_dollars",
+		Help: "Charge added by the next overage block in dollars",
+	}, usageLabels)
+
+	usageOverageNextBlockGB = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_overage_next_block_gb",
+		Help: "Usage at which the next overage block is charged in GB",
+	}, usageLabels)
+
+	usageCourtesyUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_courtesy_used",
+		Help: "Number of courtesy credits used",
+	}, usageLabels)
+
+	usageCourtesyRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_courtesy_remaining",
+		Help: "Number of courtesy credits remaining",
+	}, usageLabels)
+
+	planDownloadSpeedGbps = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_plan_download_speed_gbps",
+		Help: "Plan download speed in Gbps",
+	}, usageLabels)
+
+	planUploadSpeedGbps = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_plan_upload_speed_gbps",
+		Help: "Plan upload speed in Gbps",
+	}, usageLabels)
+
+	usageGauges = []*prometheus.GaugeVec{usageCurrentGB, usageAllowableGB, usageRemainingGB, usageEstimatedGB,
+		usageEstimatedLowGB, usageEstimatedHighGB, usageProjectedCapTimestamp, usageDailyAverageGB, usageDaysRemaining,
+		usageOverageCharge, usageOverageProjectedCost, usageOverageNextBlockCost, usageOverageNextBlockGB, usageCourtesyUsed,
+		usageCourtesyRemaining, planDownloadSpeedGbps, planUploadSpeedGbps}
+
+	// Gauge for the usage consumed over recent windows.
+	usageDeltaGB = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_delta_gb",
+		Help: "Usage consumed over a recent window (last_hour, today, yesterday, last_7_days) in GB",
+	}, []string{"account", "window"})
+
+	// Gauges for every billing cycle returned by the API, labelled by account, year and month.
+	monthlyLabels = []string{"account", "year", "month", "policy"}
+
+	monthlyUsageGB = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_monthly_usage_gb",
+		Help: "Usage of a billing cycle in GB",
+	}, monthlyLabels)
+
+	monthlyAllowableGB = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_monthly_allowable_gb",
+		Help: "Allowable usage of a billing cycle in GB",
+	}, monthlyLabels)
+
+	monthlyOverage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_monthly_overage",
+		Help: "Whether a billing cycle went over the allowance (1) or not (0)",
+	}, monthlyLabels)
+
+	monthlyOverageCharge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfinity_usage_monthly_overage_charge_dollars",
+		Help: "Overage charge of a billing cycle in dollars",
+	}, monthlyLabels)
+
+	monthlyGauges = []*prometheus.GaugeVec{monthlyUsageGB, monthlyAllowableGB, monthlyOverage, monthlyOverageCharge}
+
 	metricsRegistry = prometheus.NewRegistry()
 )
 
@@ -109,7 +253,11 @@ func init() {
 	// Register all metrics with the custom registry.
 	metricsRegistry.MustRegister(runsTotal, runsSuccessTotal, errorsTotal, lastSuccessTimestamp,
 		lastRunTimestamp, consecutiveFailures, lastRunSuccess, lastErrorTimestamp, executionDuration,
-		tokenRefreshDuration, usageFetchDuration, mqttPublishDuration, retriesTotal, buildInfo)
+		tokenRefreshDuration, usageFetchDuration, mqttPublishDuration, publishDuration, publishSuccessTotal, retriesTotal,
+		buildInfo, usageDeltaGB, alertsSentTotal)
+	for _, g := range append(usageGauges, monthlyGauges...) {
+		metricsRegistry.MustRegister(g)
+	}
 }
 
 // errorCategory represents an error category for metrics.
@@ -119,15 +267,29 @@ type errorCategory string
 const (
 	errorCategoryConfigValidation errorCategory = "config_validation"
 	errorCategoryTokenRefresh     errorCategory = "token_refresh"
+	errorCategoryTokenStore       errorCategory = "token_store"
 	errorCategoryUsageFetch       errorCategory = "usage_fetch"
 	errorCategoryUsageParse       errorCategory = "usage_parse"
-	errorCategoryMQTTPublish      errorCategory = "mqtt_publish"
+	// Publish errors of a sink are <sink>_publish unless the sink has a more specific category.
+	errorCategoryMQTTPublish errorCategory = "mqtt_publish"
+	// Home Assistant rejected the token, or the url, entity id or body of the request.
+	errorCategoryHomeAssistantAuth    errorCategory = "homeassistant_auth"
+	errorCategoryHomeAssistantRequest errorCategory = "homeassistant_request"
+	errorCategoryHistoryStore         errorCategory = "history_store"
+	errorCategoryAlertNotify          errorCategory = "alert_notify"
+	errorCategoryAlertState           errorCategory = "alert_state"
 )
 
-// recordError increments the error counter and updates the last error timestamp for a specific category.
-func recordError(category errorCategory) {
-	errorsTotal.WithLabelValues(string(category)).Inc()
-	lastErrorTimestamp.WithLabelValues(string(category)).Set(float64(time.Now().Unix()))
+// recordError increments the error counter and updates the last error timestamp for a specific
+// category and account, empty for errors that aren't specific to one.
+func recordError(category errorCategory, account string) {
+	recordSinkError(category, account, "")
+}
+
+// recordSinkError records an error of a specific output sink.
+func recordSinkError(category errorCategory, account, sink string) {
+	errorsTotal.WithLabelValues(string(category), account, sink).Inc()
+	lastErrorTimestamp.WithLabelValues(string(category), account).Set(float64(time.Now().Unix()))
 }
 
 // recordSuccess records a successful run.
@@ -172,3 +334,76 @@ func pushMetrics(ctx context.Context, endpoint string, job string) error {
 	}
 	return nil
 }
+
+// recordUsage sets the usage gauges. Previous values are dropped first so a plan or policy change
+// doesn't leave stale series behind, and values that don't apply (e.g. the allowance of an
+// unlimited policy) are left unset.
+func recordUsage(account string, u *xfinity.Usage, attributes *UsageAttributes, currentGB float32) {
+	for _, g := range usageGauges {
+		g.DeletePartialMatch(prometheus.Labels{"account": account})
+	}
+	labels := prometheus.Labels{"account": account, "policy": attributes.Policy, "plan": attributes.PlanName}
+	setIf := func(g *prometheus.GaugeVec, v *int) {
+		if v != nil {
+			g.With(labels).Set(float64(*v))
+		}
+	}
+
+	usageCurrentGB.With(labels).Set(float64(currentGB))
+	usageEstimatedGB.With(labels).Set(float64(attributes.UsageEstimated))
+	if attributes.UsageEstimatedLow != nil && attributes.UsageEstimatedHigh != nil {
+		usageEstimatedLowGB.With(labels).Set(float64(*attributes.UsageEstimatedLow))
+		usageEstimatedHighGB.With(labels).Set(float64(*attributes.UsageEstimatedHigh))
+	}
+	if capDate, err := time.ParseInLocation("2006-01-02", attributes.ProjectedCapDate, time.Local); err == nil {
+		usageProjectedCapTimestamp.With(labels).Set(float64(capDate.Unix()))
+	}
+	usageDailyAverageGB.With(labels).Set(float64(attributes.UsageDailyAverage))
+	usageDaysRemaining.With(labels).Set(float64(attributes.DaysRemaining))
+	setIf(usageAllowableGB, attributes.AllowableUsage)
+	setIf(usageRemainingGB, attributes.UsageRemaining)
+	setIf(usageOverageCharge, attributes.OverageCharges)
+	setIf(usageOverageProjectedCost, attributes.OverageProjectedCost)
+	setIf(usageOverageNextBlockCost, attributes.OverageNextBlockCost)
+	setIf(usageOverageNextBlockGB, attributes.OverageNextBlockAt)
+	if attributes.PlanDownloadSpeed != nil {
+		planDownloadSpeedGbps.With(labels).Set(float64(*attributes.PlanDownloadSpeed))
+	}
+	if attributes.PlanUploadSpeed != nil {
+		planUploadSpeedGbps.With(labels).Set(float64(*attributes.PlanUploadSpeed))
+	}
+	if courtesy := u.Data.Account.Internet.Usage.Courtesy; courtesy != nil {
+		setIf(usageCourtesyUsed, courtesy.UsedCourtesy)
+		setIf(usageCourtesyRemaining, courtesy.RemainingCourtesy)
+	}
+}
+
+// recordHistory sets the per billing cycle gauges, dropping cycles no longer returned by the API.
+func recordHistory(account string, history *UsageHistory) {
+	for _, g := range monthlyGauges {
+		g.DeletePartialMatch(prometheus.Labels{"account": account})
+	}
+	for _, m := range history.Months {
+		labels := prometheus.Labels{"account": account, "year": strconv.Itoa(m.Year), "month": strconv.Itoa(m.Month), "policy": m.Policy}
+		monthlyUsageGB.With(labels).Set(float64(m.Usage))
+		if m.AllowableUsage != nil {
+			monthlyAllowableGB.With(labels).Set(float64(*m.AllowableUsage))
+		}
+		overage := 0.0
+		if m.Overage {
+			overage = 1
+		}
+		monthlyOverage.With(labels).Set(overage)
+		if m.OverageCharges != nil {
+			monthlyOverageCharge.With(labels).Set(float64(*m.OverageCharges))
+		}
+	}
+}
+
+// recordDeltas sets the usage delta gauges.
+func recordDeltas(account string, d usageDeltas) {
+	usageDeltaGB.WithLabelValues(account, "last_hour").Set(float64(d.LastHour))
+	usageDeltaGB.WithLabelValues(account, "today").Set(float64(d.Today))
+	usageDeltaGB.WithLabelValues(account, "yesterday").Set(float64(d.Yesterday))
+	usageDeltaGB.WithLabelValues(account, "last_7_days").Set(float64(d.Last7Days))
+}
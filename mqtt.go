@@ -2,35 +2,163 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"net/url"
+	"os"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
 )
 
-func mqttPublish(ctx context.Context, mqttURL, mqttUsername, mqttPassword, mqttClientID, mqttStateTopic, mqttAttributesTopic string, usage float32, attributes *UsageAttributes) error {
-	u, err := url.Parse(mqttURL)
+// mqttConfig holds the MQTT connection and topic settings.
+type mqttConfig struct {
+	url             string
+	username        string
+	password        string
+	clientID        string
+	stateTopic      string
+	attributesTopic string
+	historyTopic    string // Disabled if empty.
+
+	// TLS settings, used for ssl://, mqtts:// and wss:// urls.
+	caFile             string
+	certFile           string
+	keyFile            string
+	serverName         string
+	insecureSkipVerify bool
+
+	// Home Assistant discovery, disabled if discoveryPrefix is empty.
+	discoveryPrefix string
+	nodeID          string
+
+	// availabilityTopic receives "online"/"offline", disabled if empty. In daemon mode it tracks
+	// the connection, otherwise it reflects whether the last fetch succeeded.
+	availabilityTopic string
+	daemon            bool
+
+	// account names the device of a multi account config in Home Assistant.
+	account string
+}
+
+const (
+	availabilityOnline  = "online"
+	availabilityOffline = "offline"
+)
+
+// mqttPublisher publishes usage data to MQTT. The connection is established lazily on the first
+// publish and kept alive (with automatic reconnects) until close is called, so it can be shared
+// across daemon cycles.
+type mqttPublisher struct {
+	cfg mqttConfig
+
+	mu     sync.Mutex
+	conn   *autopaho.ConnectionManager
+	cancel context.CancelFunc
+}
+
+func newMQTTPublisher(cfg mqttConfig) *mqttPublisher {
+	return &mqttPublisher{cfg: cfg}
+}
+
+// tlsConfig builds the TLS configuration from the CA bundle, client certificate and overrides. It
+// returns nil when nothing is configured so the system defaults are used.
+func (c mqttConfig) tlsConfig() (*tls.Config, error) {
+	if c.caFile == "" && c.certFile == "" && c.keyFile == "" && c.serverName == "" && !c.insecureSkipVerify {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.serverName,
+		InsecureSkipVerify: c.insecureSkipVerify,
+	}
+	if c.caFile != "" {
+		ca, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mqtt ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("failed to parse mqtt ca file %s", c.caFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if c.certFile != "" || c.keyFile != "" {
+		// Fail early on a bad key pair, but reload it on every handshake so rotated certificates
+		// are picked up by long-running daemons.
+		if _, err := tls.LoadX509KeyPair(c.certFile, c.keyFile); err != nil {
+			return nil, fmt.Errorf("failed to load mqtt client certificate: %w", err)
+		}
+		tlsCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load mqtt client certificate: %w", err)
+			}
+			return &cert, nil
+		}
+	}
+	return tlsCfg, nil
+}
+
+// connection returns the current connection, creating it if needed.
+func (m *mqttPublisher) connection() (*autopaho.ConnectionManager, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn != nil {
+		return m.conn, nil
+	}
+
+	u, err := url.Parse(m.cfg.url)
 	if err != nil {
-		return fmt.Errorf("failed to parse mqtt server url: %v", err)
+		return nil, fmt.Errorf("failed to parse mqtt server url: %v", err)
+	}
+	tlsCfg, err := m.cfg.tlsConfig()
+	if err != nil {
+		return nil, err
 	}
 	mqttLogger := &logger{prefix: "mqtt: "}
 	cfg := autopaho.ClientConfig{
 		ServerUrls:                    []*url.URL{u},
+		TlsCfg:                        tlsCfg,
 		KeepAlive:                     20,
 		CleanStartOnInitialConnection: true,
 		SessionExpiryInterval:         10,
-		ConnectUsername:               mqttUsername,
-		ConnectPassword:               []byte(mqttPassword),
+		ConnectUsername:               m.cfg.username,
+		ConnectPassword:               []byte(m.cfg.password),
 		Debug:                         mqttLogger.AsDebug(),
 		Errors:                        mqttLogger.AsWarn(),
 		PahoDebug:                     mqttLogger.AsDebug(),
 		PahoErrors:                    mqttLogger.AsWarn(),
 	}
+	if m.cfg.availabilityTopic != "" {
+		// The broker publishes the will if the connection is lost without a clean disconnect.
+		cfg.WillMessage = &paho.WillMessage{
+			Topic:   m.cfg.availabilityTopic,
+			Payload: []byte(availabilityOffline),
+			Retain:  true,
+			QoS:     1,
+		}
+		if m.cfg.daemon {
+			cfg.OnConnectionUp = func(c *autopaho.ConnectionManager, _ *paho.Connack) {
+				// Must not block, and runs again after every reconnect to replace the will.
+				go func() {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+					if err := publishAvailability(ctx, c, m.cfg.availabilityTopic, true); err != nil {
+						mqttLogger.AsWarn().Printf("%s", err)
+					}
+				}()
+			}
+		}
+	}
 	cfg.ClientConfig = paho.ClientConfig{
-		ClientID: mqttClientID,
+		ClientID: m.cfg.clientID,
 		OnClientError: func(err error) {
 			mqttLogger.AsWarn().Printf("client error: %s", err)
 		},
@@ -42,44 +170,167 @@ func mqttPublish(ctx context.Context, mqttURL, mqttUsername, mqttPassword, mqttC
 			}
 		},
 	}
+
+	// The connection outlives any single publish, so it gets its own context that is only
+	// cancelled by close.
+	ctx, cancel := context.WithCancel(context.Background())
 	c, err := autopaho.NewConnection(ctx, cfg)
 	if err != nil {
-		return err
+		cancel()
+		return nil, err
+	}
+	m.conn = c
+	m.cancel = cancel
+	return c, nil
+}
+
+// mqttMessage is a retained message published to a topic.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// usageMessages returns the messages published on every fetch: the Home Assistant discovery
+// configs, if enabled, followed by the state and the attributes.
+func (c mqttConfig) usageMessages(usage float32, attributes *UsageAttributes) ([]mqttMessage, error) {
+	var msgs []mqttMessage
+
+	// Discovery configs go first so the entities exist when the state arrives.
+	if c.discoveryPrefix != "" {
+		configs, err := c.discoveryConfigs(attributes)
+		if err != nil {
+			return nil, err
+		}
+		for _, topic := range slices.Sorted(maps.Keys(configs)) {
+			msgs = append(msgs, mqttMessage{topic: topic, payload: configs[topic]})
+		}
+	}
+
+	// State (numeric value).
+	msgs = append(msgs, mqttMessage{topic: c.stateTopic, payload: fmt.Appendf(nil, "%.2f", usage)})
+
+	// Attributes (JSON).
+	if c.availabilityTopic != "" {
+		withTopic := *attributes
+		withTopic.AvailabilityTopic = c.availabilityTopic
+		attributes = &withTopic
+	}
+	attrs, err := json.Marshal(attributes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal attributes: %w", err)
+	}
+	return append(msgs, mqttMessage{topic: c.attributesTopic, payload: attrs}), nil
+}
+
+// historyMessage returns the message with every billing cycle, or nil if the history topic is
+// disabled.
+func (c mqttConfig) historyMessage(history *UsageHistory) (*mqttMessage, error) {
+	if c.historyTopic == "" {
+		return nil, nil
+	}
+	payload, err := json.Marshal(history)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal history: %w", err)
 	}
-	defer func() {
-		disconnectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		c.Disconnect(disconnectCtx)
-		<-c.Done()
-	}()
+	return &mqttMessage{topic: c.historyTopic, payload: payload}, nil
+}
 
+func (m *mqttPublisher) name() string {
+	return sinkMQTT
+}
+
+// publish writes the usage state, attributes and history to their retained topics.
+func (m *mqttPublisher) publish(ctx context.Context, usage float32, attributes *UsageAttributes, history *UsageHistory) error {
+	msgs, err := m.cfg.usageMessages(usage, attributes)
+	if err != nil {
+		return err
+	}
+	hm, err := m.cfg.historyMessage(history)
+	if err != nil {
+		return err
+	}
+	if hm != nil {
+		msgs = append(msgs, *hm)
+	}
+	c, err := m.connection()
+	if err != nil {
+		return err
+	}
 	if err = c.AwaitConnection(ctx); err != nil {
 		return err
 	}
+	for _, msg := range msgs {
+		if err := publishRetained(ctx, c, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Publish state (numeric value).
-	if _, err = c.Publish(ctx, &paho.Publish{
-		Topic:   mqttStateTopic,
+func publishRetained(ctx context.Context, c *autopaho.ConnectionManager, msg mqttMessage) error {
+	if _, err := c.Publish(ctx, &paho.Publish{
+		Topic:   msg.topic,
 		Retain:  true,
 		QoS:     1,
-		Payload: fmt.Appendf(nil, "%.2f", usage),
+		Payload: msg.payload,
 	}); err != nil {
-		return fmt.Errorf("failed to publish state: %w", err)
+		return fmt.Errorf("failed to publish %s: %w", msg.topic, err)
 	}
+	return nil
+}
 
-	// Publish attributes (JSON).
-	attrs, err := json.Marshal(attributes)
+// publishStatus publishes whether the last fetch succeeded to the availability topic. It is only
+// used outside daemon mode, where availability can't track the connection.
+func (m *mqttPublisher) publishStatus(ctx context.Context, ok bool) error {
+	if m.cfg.availabilityTopic == "" || m.cfg.daemon {
+		return nil
+	}
+	c, err := m.connection()
 	if err != nil {
-		return fmt.Errorf("failed to marshal attributes: %w", err)
+		return err
+	}
+	if err = c.AwaitConnection(ctx); err != nil {
+		return err
 	}
-	if _, err = c.Publish(ctx, &paho.Publish{
-		Topic:   mqttAttributesTopic,
+	return publishAvailability(ctx, c, m.cfg.availabilityTopic, ok)
+}
+
+func publishAvailability(ctx context.Context, c *autopaho.ConnectionManager, topic string, online bool) error {
+	payload := availabilityOffline
+	if online {
+		payload = availabilityOnline
+	}
+	if _, err := c.Publish(ctx, &paho.Publish{
+		Topic:   topic,
 		Retain:  true,
 		QoS:     1,
-		Payload: attrs,
+		Payload: []byte(payload),
 	}); err != nil {
-		return fmt.Errorf("failed to publish attributes: %w", err)
+		return fmt.Errorf("failed to publish availability: %w", err)
 	}
-
 	return nil
 }
+
+// close disconnects from the broker, if connected. In daemon mode it first marks the sensors as
+// offline, since a clean disconnect doesn't trigger the will. It uses its own timeout so a
+// cancelled parent context does not cause spurious errors on shutdown.
+func (m *mqttPublisher) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return
+	}
+	disconnectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if m.cfg.availabilityTopic != "" && m.cfg.daemon {
+		if err := m.conn.AwaitConnection(disconnectCtx); err == nil {
+			if err := publishAvailability(disconnectCtx, m.conn, m.cfg.availabilityTopic, false); err != nil {
+				(&logger{prefix: "mqtt: "}).AsWarn().Printf("%s", err)
+			}
+		}
+	}
+	m.conn.Disconnect(disconnectCtx)
+	m.cancel()
+	<-m.conn.Done()
+	m.conn = nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds every notification request. The requests aren't retried since the services
+// would deliver the alert twice, an alert that failed is sent again on the next run instead.
+const notifyTimeout = 30 * time.Second
+
+// notifier sends alerts to a notification channel.
+type notifier interface {
+	name() string
+	notify(ctx context.Context, al alert) error
+}
+
+// httpNotifier POSTs alerts to an HTTP endpoint, with a body and headers specific to the service.
+type httpNotifier struct {
+	kind   string
+	client *http.Client
+	url    string
+	header http.Header
+	// titleHeader, if set, is the header carrying the alert title.
+	titleHeader string
+	body        func(al alert) ([]byte, error)
+}
+
+func (n *httpNotifier) name() string {
+	return n.kind
+}
+
+func (n *httpNotifier) notify(ctx context.Context, al alert) error {
+	body, err := n.body(al)
+	if err != nil {
+		return fmt.Errorf("failed to build %s request body: %w", n.kind, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create %s request: %w", n.kind, err)
+	}
+	for k, v := range n.header {
+		req.Header[k] = v
+	}
+	if n.titleHeader != "" {
+		req.Header.Set(n.titleHeader, al.Title)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send %s request: %w", n.kind, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s request %w", n.kind, &statusError{StatusCode: resp.StatusCode, Body: respBody})
+	}
+	return nil
+}
+
+func jsonBody(v func(al alert) any) func(al alert) ([]byte, error) {
+	return func(al alert) ([]byte, error) { return json.Marshal(v(al)) }
+}
+
+// newWebhookNotifier POSTs the alert, including the usage attributes, as JSON.
+func newWebhookNotifier(client *http.Client, url string) notifier {
+	return &httpNotifier{
+		kind:   "webhook",
+		client: client,
+		url:    url,
+		header: http.Header{"Content-Type": {"application/json"}},
+		body:   jsonBody(func(al alert) any { return al }),
+	}
+}
+
+// newNtfyNotifier publishes to an ntfy topic URL, e.g. https://ntfy.sh/my-topic, with an optional
+// access token.
+func newNtfyNotifier(client *http.Client, topicURL, token string) notifier {
+	header := http.Header{"Tags": {"warning"}}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return &httpNotifier{
+		kind:        "ntfy",
+		client:      client,
+		url:         topicURL,
+		header:      header,
+		titleHeader: "Title",
+		body: func(al alert) ([]byte, error) {
+			return []byte(al.Message), nil
+		},
+	}
+}
+
+// newGotifyNotifier sends a message to a Gotify server with an application token.
+func newGotifyNotifier(client *http.Client, serverURL, token string) notifier {
+	return &httpNotifier{
+		kind:   "gotify",
+		client: client,
+		url:    strings.TrimSuffix(serverURL, "/") + "/message",
+		header: http.Header{"Content-Type": {"application/json"}, "X-Gotify-Key": {token}},
+		body: jsonBody(func(al alert) any {
+			return map[string]any{"title": al.Title, "message": al.Message, "priority": 5}
+		}),
+	}
+}
+
+// newSlackNotifier posts to a Slack incoming webhook. Discord webhooks are supported as well, they
+// read content instead of text.
+func newSlackNotifier(client *http.Client, url string) notifier {
+	return &httpNotifier{
+		kind:   "slack",
+		client: client,
+		url:    url,
+		header: http.Header{"Content-Type": {"application/json"}},
+		body: jsonBody(func(al alert) any {
+			text := fmt.Sprintf("*%s*\n%s", al.Title, al.Message)
+			return map[string]string{"text": text, "content": text}
+		}),
+	}
+}
+
+// smtpNotifier emails alerts. The connection is upgraded with STARTTLS when the server supports
+// it, and authentication is only attempted if a username is set.
+type smtpNotifier struct {
+	addr     string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func newSMTPNotifier(addr, username, password, from string, to []string) notifier {
+	return &smtpNotifier{addr: addr, username: username, password: password, from: from, to: to}
+}
+
+func (n *smtpNotifier) name() string {
+	return "smtp"
+}
+
+func (n *smtpNotifier) notify(ctx context.Context, al alert) error {
+	var auth smtp.Auth
+	if n.username != "" {
+		host, _, err := net.SplitHostPort(n.addr)
+		if err != nil {
+			return fmt.Errorf("invalid smtp address %q: %w", n.addr, err)
+		}
+		auth = smtp.PlainAuth("", n.username, n.password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", al.Title)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", al.Message)
+
+	// net/smtp has no context support, so give up waiting on it once the context is done.
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(n.addr, auth, n.from, n.to, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to send email: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to send email: %w", ctx.Err())
+	}
+}
+
+// statusError is returned when an HTTP service, e.g. a notifier or an output sink, responds with a
+// non-2xx status.
+type statusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("failed with request status %d: %s", e.StatusCode, e.Body)
+}
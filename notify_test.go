@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func testAlert() alert {
+	allowable := 1229
+	return alert{
+		Account:    "home",
+		Rule:       "usage:80",
+		Title:      "Xfinity usage reached 80% of the allowance (home)",
+		Message:    "Used 1000 GB of 1229 GB with 5 days remaining.",
+		Attributes: &UsageAttributes{StartDate: "2026-10-01", AllowableUsage: &allowable},
+	}
+}
+
+func TestHTTPNotifiers(t *testing.T) {
+	al := testAlert()
+	slackText := "*" + al.Title + "*\n" + al.Message
+	tests := []struct {
+		name       string
+		notifier   func(client *http.Client, url string) notifier
+		wantPath   string
+		wantHeader map[string]string
+		// wantBody is the expected body, compared as JSON unless wantRaw is set.
+		wantBody string
+		wantRaw  bool
+	}{
+		{
+			name:       "webhook",
+			notifier:   newWebhookNotifier,
+			wantPath:   "/hook",
+			wantHeader: map[string]string{"Content-Type": "application/json"},
+			wantBody: `{"account":"home","rule":"usage:80","title":"Xfinity usage reached 80% of the allowance (home)",
+				"message":"Used 1000 GB of 1229 GB with 5 days remaining.",
+				"attributes":{"friendly_name":"","unit_of_measurement":"","device_class":"","state_class":"","icon":"",
+				"start_date":"2026-10-01","end_date":"","days_remaining":0,"usage_estimated":0,"usage_daily_average":0,
+				"allowable_usage":1229,"policy":""}}`,
+		},
+		{
+			name: "ntfy",
+			notifier: func(client *http.Client, url string) notifier {
+				return newNtfyNotifier(client, url, "ntfy-token")
+			},
+			wantPath: "/hook",
+			wantHeader: map[string]string{
+				"Authorization": "Bearer ntfy-token",
+				"Title":         al.Title,
+				"Tags":          "warning",
+			},
+			wantBody: al.Message,
+			wantRaw:  true,
+		},
+		{
+			name: "gotify",
+			notifier: func(client *http.Client, url string) notifier {
+				return newGotifyNotifier(client, url+"/", "gotify-token")
+			},
+			wantPath:   "/hook/message",
+			wantHeader: map[string]string{"Content-Type": "application/json", "X-Gotify-Key": "gotify-token"},
+			wantBody:   `{"title":"Xfinity usage reached 80% of the allowance (home)","message":"Used 1000 GB of 1229 GB with 5 days remaining.","priority":5}`,
+		},
+		{
+			name:       "slack",
+			notifier:   newSlackNotifier,
+			wantPath:   "/hook",
+			wantHeader: map[string]string{"Content-Type": "application/json"},
+			wantBody:   mustJSON(t, map[string]string{"text": slackText, "content": slackText}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotMethod, gotPath string
+			var gotHeader http.Header
+			var gotBody []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotMethod, gotPath, gotHeader = r.Method, r.URL.Path, r.Header
+				gotBody, _ = io.ReadAll(r.Body)
+			}))
+			defer srv.Close()
+
+			n := tt.notifier(srv.Client(), srv.URL+"/hook")
+			if n.name() != tt.name {
+				t.Errorf("name() = %q, want %q", n.name(), tt.name)
+			}
+			if err := n.notify(context.Background(), al); err != nil {
+				t.Fatalf("notify() = %v", err)
+			}
+			if gotMethod != http.MethodPost {
+				t.Errorf("method = %q, want POST", gotMethod)
+			}
+			if gotPath != tt.wantPath {
+				t.Errorf("path = %q, want %q", gotPath, tt.wantPath)
+			}
+			for k, want := range tt.wantHeader {
+				if got := gotHeader.Get(k); got != want {
+					t.Errorf("header %s = %q, want %q", k, got, want)
+				}
+			}
+			if tt.wantRaw {
+				if string(gotBody) != tt.wantBody {
+					t.Errorf("body = %q, want %q", gotBody, tt.wantBody)
+				}
+				return
+			}
+			var got, want any
+			if err := json.Unmarshal(gotBody, &got); err != nil {
+				t.Fatalf("failed to parse body %q: %v", gotBody, err)
+			}
+			if err := json.Unmarshal([]byte(tt.wantBody), &want); err != nil {
+				t.Fatal(err)
+			}
+			if mustJSON(t, got) != mustJSON(t, want) {
+				t.Errorf("body = %s, want %s", gotBody, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHTTPNotifierStatusError(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	err := newWebhookNotifier(&http.Client{Timeout: notifyTimeout}, srv.URL).notify(context.Background(), testAlert())
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("notify() = %v, want a 503 status error", err)
+	}
+	if calls != 1 {
+		t.Errorf("server was called %d times, want 1 since notifications aren't retried", calls)
+	}
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// fakeSMTPServer accepts a single SMTP session without TLS and records what it received.
+type fakeSMTPServer struct {
+	addr string
+	done chan struct{}
+
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &fakeSMTPServer{addr: l.Addr().String(), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s.serve(textproto.NewConn(conn))
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) serve(c *textproto.Conn) {
+	c.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			c.PrintfLine("250-localhost")
+			c.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			s.auth = arg
+			c.PrintfLine("235 2.7.0 Authentication successful")
+		case "MAIL":
+			s.from = arg
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			s.to = append(s.to, arg)
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(c.DotReader())
+			if err != nil {
+				return
+			}
+			s.data = string(data)
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	srv := newFakeSMTPServer(t)
+	al := testAlert()
+	n := newSMTPNotifier(srv.addr, "user", "secret", "xfinity@example.com", []string{"a@example.com", "b@example.com"})
+	if err := n.notify(context.Background(), al); err != nil {
+		t.Fatalf("notify() = %v", err)
+	}
+	<-srv.done
+
+	if want := "PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")); srv.auth != want {
+		t.Errorf("auth = %q, want %q", srv.auth, want)
+	}
+	if want := "FROM:<xfinity@example.com>"; !strings.HasPrefix(srv.from, want) {
+		t.Errorf("MAIL %q, want %q", srv.from, want)
+	}
+	if want := []string{"TO:<a@example.com>", "TO:<b@example.com>"}; strings.Join(srv.to, ",") != strings.Join(want, ",") {
+		t.Errorf("RCPT = %q, want %q", srv.to, want)
+	}
+
+	msg, err := textproto.NewReader(bufio.NewReader(strings.NewReader(srv.data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("failed to parse message %q: %v", srv.data, err)
+	}
+	for k, want := range map[string]string{
+		"From":         "xfinity@example.com",
+		"To":           "a@example.com, b@example.com",
+		"Subject":      al.Title,
+		"Content-Type": "text/plain; charset=utf-8",
+	} {
+		if got := msg.Get(k); got != want {
+			t.Errorf("header %s = %q, want %q", k, got, want)
+		}
+	}
+	if msg.Get("Date") == "" {
+		t.Error("missing Date header")
+	}
+	if _, body, _ := strings.Cut(srv.data, "\n\n"); strings.TrimSpace(body) != al.Message {
+		t.Errorf("body = %q, want %q", body, al.Message)
+	}
+}
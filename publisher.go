@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output sinks selected by --sinks.
+const (
+	sinkMQTT          = "mqtt"
+	sinkInfluxDB      = "influxdb"
+	sinkHomeAssistant = "homeassistant"
+)
+
+// sinkNames lists the supported output sinks.
+var sinkNames = []string{sinkMQTT, sinkInfluxDB, sinkHomeAssistant}
+
+// publisher sends the usage of every fetch to an output sink.
+type publisher interface {
+	// name identifies the sink in logs and metrics.
+	name() string
+	publish(ctx context.Context, usage float32, attributes *UsageAttributes, history *UsageHistory) error
+	close()
+}
+
+// statusPublisher is implemented by the sinks that also report whether the last fetch succeeded,
+// which is only done outside daemon mode.
+type statusPublisher interface {
+	publishStatus(ctx context.Context, ok bool) error
+}
+
+// sinks returns the names of the selected output sinks, without duplicates. An empty list disables
+// publishing, e.g. to only export metrics.
+func (c config) sinks() []string {
+	var out []string
+	for _, s := range strings.Split(c.sinkList, ",") {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" && s != "none" && !slices.Contains(out, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// sinkEnabled reports whether the output sink is selected.
+func (c config) sinkEnabled(name string) bool {
+	return slices.Contains(c.sinks(), name)
+}
+
+// validateSinks reports the unknown sink names.
+func (c config) validateSinks() []error {
+	var errs []error
+	for _, s := range c.sinks() {
+		if !slices.Contains(sinkNames, s) {
+			errs = append(errs, fmt.Errorf("unknown sink %q, expected one of %s", s, strings.Join(sinkNames, ", ")))
+		}
+	}
+	return errs
+}
+
+// newPublishers creates the publishers of the selected sinks for an account. The HTTP sinks use
+// client.
+func newPublishers(account accountConfig, client *http.Client) ([]publisher, error) {
+	var out []publisher
+	for _, s := range cfg.sinks() {
+		switch s {
+		case sinkMQTT:
+			out = append(out, newMQTTPublisher(cfg.mqttFor(account)))
+		case sinkInfluxDB:
+			c, err := cfg.influxFor(account)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, newInfluxPublisher(c, client))
+		case sinkHomeAssistant:
+			out = append(out, newHomeAssistantPublisher(cfg.homeAssistantFor(account), client))
+		}
+	}
+	return out, nil
+}
+
+// sinkError is a publish error with a more specific metrics category than <sink>_publish.
+type sinkError struct {
+	category errorCategory
+	err      error
+}
+
+func (e *sinkError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sinkError) Unwrap() error {
+	return e.err
+}
+
+// publishErrorCategory returns the metrics category of a publish error of the sink, e.g.
+// errorCategoryMQTTPublish.
+func publishErrorCategory(sink string, err error) errorCategory {
+	var se *sinkError
+	if errors.As(err, &se) {
+		return se.category
+	}
+	return errorCategory(sink + "_publish")
+}
+
+// publishAll sends the usage of the account to every publisher concurrently, so a slow or
+// blocking sink, e.g. an unreachable MQTT broker, doesn't stop the others. The errors are joined,
+// and the success or error of every sink is recorded with the sink label.
+func publishAll(ctx context.Context, account string, publishers []publisher, usage float32, attributes *UsageAttributes, history *UsageHistory) error {
+	errs := make([]error, len(publishers))
+	var wg sync.WaitGroup
+	for i, p := range publishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := p.publish(ctx, usage, attributes, history)
+			elapsed := time.Since(start).Seconds()
+			publishDuration.WithLabelValues(p.name()).Observe(elapsed)
+			if p.name() == sinkMQTT {
+				mqttPublishDuration.Observe(elapsed)
+			}
+			if err != nil {
+				recordSinkError(publishErrorCategory(p.name(), err), account, p.name())
+				errs[i] = fmt.Errorf("failed to publish to %s: %w", p.name(), err)
+				return
+			}
+			publishSuccessTotal.WithLabelValues(p.name()).Inc()
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakePublisher succeeds right away, or blocks until the context is done if block is set.
+type fakePublisher struct {
+	sink  string
+	block bool
+}
+
+func (p *fakePublisher) name() string { return p.sink }
+
+func (p *fakePublisher) publish(ctx context.Context, _ float32, _ *UsageAttributes, _ *UsageHistory) error {
+	if p.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (p *fakePublisher) close() {}
+
+func counterValue(t *testing.T, c interface{ Write(*dto.Metric) error }) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestPublishAllBlockingSink(t *testing.T) {
+	blocking, fast := &fakePublisher{sink: "test_blocking", block: true}, &fakePublisher{sink: "test_fast"}
+	successes := publishSuccessTotal.WithLabelValues(fast.sink)
+	failures := errorsTotal.WithLabelValues("test_blocking_publish", "home", blocking.sink)
+	wantSuccesses, wantFailures := counterValue(t, successes)+1, counterValue(t, failures)+1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- publishAll(ctx, "home", []publisher{blocking, fast}, 1, &UsageAttributes{}, nil) }()
+
+	// The fast sink succeeds while the blocking one still waits.
+	for deadline := time.Now().Add(5 * time.Second); counterValue(t, successes) != wantSuccesses; {
+		if time.Now().After(deadline) {
+			t.Fatal("the fast sink didn't publish while the other one was blocked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("publishAll() = %v before the blocking sink returned", err)
+	default:
+	}
+
+	cancel()
+	err := <-done
+	if err == nil || !strings.Contains(err.Error(), "failed to publish to test_blocking") || strings.Contains(err.Error(), "test_fast") {
+		t.Errorf("publishAll() = %v, want only the error of the blocking sink", err)
+	}
+	if got := counterValue(t, failures); got != wantFailures {
+		t.Errorf("errors of the blocking sink = %v, want %v", got, wantFailures)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/google/logger"
+	"github.com/robfig/cron/v3"
+)
+
+// newSchedule builds the daemon schedule from either --schedule (cron) or --interval.
+func newSchedule(schedule string, interval time.Duration) (cron.Schedule, error) {
+	if schedule != "" {
+		s, err := cron.ParseStandard(schedule)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse schedule %q: %w", schedule, err)
+		}
+		return s, nil
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive, got %s", interval)
+	}
+	return cron.Every(interval), nil
+}
+
+// nextRun returns when the next cycle should start. After failures the regular schedule is
+// shortened with an exponential backoff (capped at the next scheduled run) and a random jitter
+// is always added so multiple instances don't hit the API at the same time. The jitter is added
+// before the cap, so a retry never lands after the next scheduled run.
+func nextRun(now time.Time, sched cron.Schedule, failures int, backoff, jitter time.Duration) time.Time {
+	var j time.Duration
+	if jitter > 0 {
+		j = rand.N(jitter)
+	}
+	next := sched.Next(now).Add(j)
+	if failures > 0 && backoff > 0 {
+		delay := backoff << min(failures-1, 16)
+		if retry := now.Add(delay + j); delay > 0 && retry.Before(next) {
+			next = retry
+		}
+	}
+	return next
+}
+
+// publisherSecrets are the secrets used by the publishers. The alert_ ones are used by the
+// notifiers and the others are the credentials of the accounts.
+var publisherSecrets = []string{"--mqtt_password", "--influxdb_token", "--influxdb_password", "--homeassistant_token"}
+
+// reloadApps re-reads the secret files and, if any changed, returns the apps updated with the new
+// values. Only what uses a changed secret is recreated, see app.reload, so the accounts keep their
+// cached tokens, connections and alerts already sent. The current apps are kept if the new ones
+// can't be created.
+func reloadApps(ctx context.Context, apps []*app, ready *readiness) []*app {
+	changed, err := reloadSecretFiles()
+	if err != nil {
+		recordError(errorCategoryConfigValidation, "")
+		log.Errorf("daemon: %v", err)
+	}
+	if len(changed) == 0 {
+		return apps
+	}
+	log.Infof("daemon: %s changed, reloading", strings.Join(changed, ", "))
+	// The current apps keep their copy of the previous values, so they keep running if the new
+	// ones are invalid.
+	if err := validateConfig(); err != nil {
+		log.Errorf("daemon: not reloading: %v", err)
+		return apps
+	}
+	var publishers, notifiers bool
+	for _, key := range changed {
+		publishers = publishers || slices.Contains(publisherSecrets, key)
+		notifiers = notifiers || strings.HasPrefix(key, "--alert_")
+	}
+	accounts := map[string]accountConfig{}
+	for _, account := range cfg.accountList() {
+		accounts[account.Name] = account
+	}
+
+	next := make([]*app, 0, len(apps))
+	for _, a := range apps {
+		n, err := a.reload(ctx, accounts[a.account.Name], publishers, notifiers)
+		if err != nil {
+			log.Errorf("daemon: failed to reload: %v", a.wrap(err))
+			if publishers {
+				closeApps(next)
+			}
+			return apps
+		}
+		next = append(next, n)
+	}
+	for i, a := range next {
+		if publishers {
+			apps[i].close()
+		}
+		ready.setTokens(a.account.Name, a.tokens)
+	}
+	return next
+}
+
+// runDaemon runs cycles on the configured schedule until the context is cancelled. The HTTP
+// client, tokens and MQTT connection are shared across cycles.
+func runDaemon(ctx context.Context, ready *readiness, histories map[string]*historyStore) error {
+	sched, err := newSchedule(cfg.schedule, cfg.interval)
+	if err != nil {
+		return err
+	}
+	apps, err := newApps(ctx, ready, histories)
+	if err != nil {
+		return err
+	}
+	defer func() { closeApps(apps) }()
+
+	failures := 0
+	for first := true; ; first = false {
+		if !first {
+			apps = reloadApps(ctx, apps, ready)
+		}
+		err := observeRun(ctx, func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+			defer cancel()
+			return runAccounts(ctx, apps, func(ctx context.Context, a *app) error {
+				return a.run(ctx)
+			})
+		})
+		if ctx.Err() != nil {
+			log.Info("daemon: shutting down")
+			return nil
+		}
+		if err != nil {
+			failures++
+			log.Errorf("daemon: run failed (%d consecutive): %v", failures, err)
+		} else {
+			failures = 0
+		}
+
+		now := time.Now()
+		next := nextRun(now, sched, failures, cfg.retryBackoff, cfg.jitter)
+		log.Infof("daemon: next run at %s", next.Format(time.RFC3339))
+
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Info("daemon: shutting down")
+			return nil
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// secretFile is a secret config field that can also be read from a file, e.g. a Docker or
+// Kubernetes secret mount, so it doesn't show up in the process arguments or environment.
+type secretFile struct {
+	// key and fileKey name the secret and its file in messages.
+	key     string
+	fileKey string
+	path    string
+	dest    *string
+
+	modTime time.Time
+	size    int64
+}
+
+var secretFiles []*secretFile
+
+// secretFileVar defines the --<name>_file flag (and <NAME>_FILE environment variable) to read the
+// --<name> secret from.
+func secretFileVar(dest *string, name string) {
+	s := &secretFile{key: "--" + name, fileKey: "--" + name + "_file", dest: dest}
+	flag.StringVar(&s.path, name+"_file", os.Getenv(envVar(name+"_file", flagEnv[name]+"_FILE")), fmt.Sprintf("File to read --%s from", name))
+	secretFiles = append(secretFiles, s)
+}
+
+// loadSecretFiles reads every secret file that is set.
+func loadSecretFiles() error {
+	var errs []error
+	for _, s := range secretFiles {
+		if s.path == "" {
+			continue
+		}
+		if *s.dest != "" {
+			errs = append(errs, fmt.Errorf("only one of %s or %s can be provided", s.key, s.fileKey))
+			continue
+		}
+		if _, err := s.load(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reloadSecretFiles re-reads the secret files that changed since they were last read and returns
+// the names of the secrets whose value changed.
+func reloadSecretFiles() ([]string, error) {
+	var changed []string
+	var errs []error
+	for _, s := range secretFiles {
+		if s.path == "" {
+			continue
+		}
+		ok, err := s.load()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			changed = append(changed, s.key)
+		}
+	}
+	return changed, errors.Join(errs...)
+}
+
+// load reads the file, trimming surrounding whitespace, unless it's unchanged since the last read.
+// It reports whether the value changed.
+func (s *secretFile) load() (bool, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", s.fileKey, err)
+	}
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return false, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", s.fileKey, err)
+	}
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+	value := strings.TrimSpace(string(data))
+	if value == *s.dest {
+		return false, nil
+	}
+	*s.dest = value
+	return true, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSecretFiles replaces the secret files with ones for the given destinations, read from files
+// named after the keys in a temporary directory.
+func testSecretFiles(t *testing.T, dests map[string]*string) string {
+	t.Helper()
+	saveConfig(t)
+	dir := t.TempDir()
+	secretFiles = nil
+	for _, key := range slices.Sorted(maps.Keys(dests)) {
+		secretFiles = append(secretFiles, &secretFile{key: "--" + key, fileKey: "--" + key + "_file", path: filepath.Join(dir, key), dest: dests[key]})
+	}
+	return dir
+}
+
+// writeSecret writes the file with a new modification time, so it's detected even on file systems
+// with a coarse time resolution.
+func writeSecret(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Duration(len(data)) * time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	var secret, token string
+	dir := testSecretFiles(t, map[string]*string{"client_secret": &secret, "refresh_token": &token})
+	writeSecret(t, filepath.Join(dir, "client_secret"), "  secret\n")
+	writeSecret(t, filepath.Join(dir, "refresh_token"), "token\r\n")
+
+	if err := loadSecretFiles(); err != nil {
+		t.Fatalf("loadSecretFiles() = %v", err)
+	}
+	if secret != "secret" || token != "token" {
+		t.Errorf("got %q and %q, want the trimmed secret and token", secret, token)
+	}
+}
+
+func TestLoadSecretFilesErrors(t *testing.T) {
+	secret, token, password := "flag", "", ""
+	dir := testSecretFiles(t, map[string]*string{"client_secret": &secret, "refresh_token": &token, "mqtt_password": &password})
+	writeSecret(t, filepath.Join(dir, "client_secret"), "file")
+	writeSecret(t, filepath.Join(dir, "mqtt_password"), "password")
+	// The refresh token file doesn't exist.
+
+	err := loadSecretFiles()
+	if err == nil {
+		t.Fatal("loadSecretFiles() = nil, want errors")
+	}
+	for _, want := range []string{"only one of --client_secret or --client_secret_file", "failed to read --refresh_token_file"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("loadSecretFiles() = %v, want %q", err, want)
+		}
+	}
+	if secret != "flag" || password != "password" {
+		t.Errorf("got %q and %q, want the flag secret and the password file", secret, password)
+	}
+}
+
+func TestLoadSecretFilesSkipsUnset(t *testing.T) {
+	secret := "flag"
+	testSecretFiles(t, map[string]*string{"client_secret": &secret})
+	secretFiles[0].path = ""
+	if err := loadSecretFiles(); err != nil || secret != "flag" {
+		t.Errorf("loadSecretFiles() = %v with %q, want the flag secret", err, secret)
+	}
+	if changed, err := reloadSecretFiles(); err != nil || len(changed) != 0 {
+		t.Errorf("reloadSecretFiles() = %v, %v, want no changes", changed, err)
+	}
+}
+
+func TestReloadSecretFiles(t *testing.T) {
+	var secret, token string
+	dir := testSecretFiles(t, map[string]*string{"client_secret": &secret, "refresh_token": &token})
+	writeSecret(t, filepath.Join(dir, "client_secret"), "secret")
+	writeSecret(t, filepath.Join(dir, "refresh_token"), "token-1")
+	if err := loadSecretFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name        string
+		write       map[string]string
+		wantChanged []string
+	}{
+		{name: "unchanged"},
+		{name: "rotated", write: map[string]string{"refresh_token": "token-2\n"}, wantChanged: []string{"--refresh_token"}},
+		// The file changed but not the trimmed value.
+		{name: "same value", write: map[string]string{"refresh_token": "  token-2 \n"}},
+		{name: "both", write: map[string]string{"client_secret": "new secret", "refresh_token": "token-3"}, wantChanged: []string{"--client_secret", "--refresh_token"}},
+		{name: "removed", write: map[string]string{"client_secret": ""}, wantChanged: []string{"--client_secret"}},
+	}
+	for _, step := range steps {
+		for name, data := range step.write {
+			writeSecret(t, filepath.Join(dir, name), data)
+		}
+		changed, err := reloadSecretFiles()
+		if err != nil {
+			t.Fatalf("%s: reloadSecretFiles() = %v", step.name, err)
+		}
+		if !slices.Equal(changed, step.wantChanged) {
+			t.Errorf("%s: changed = %v, want %v", step.name, changed, step.wantChanged)
+		}
+	}
+	if secret != "" || token != "token-3" {
+		t.Errorf("got %q and %q, want an empty secret and token-3", secret, token)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "refresh_token")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadSecretFiles(); err == nil || token != "token-3" {
+		t.Errorf("reloadSecretFiles() = %v with %q, want an error and the previous token", err, token)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/google/logger"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// readiness tracks the state reported by /readyz for every account.
+type readiness struct {
+	maxAge time.Duration
+
+	mu          sync.Mutex
+	tokens      map[string]*tokenManager
+	lastSuccess map[string]time.Time
+}
+
+func (r *readiness) setTokens(account string, tokens *tokenManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tokens == nil {
+		r.tokens = map[string]*tokenManager{}
+	}
+	r.tokens[account] = tokens
+}
+
+func (r *readiness) success(account string, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lastSuccess == nil {
+		r.lastSuccess = map[string]time.Time{}
+	}
+	r.lastSuccess[account] = t
+}
+
+// check returns an error unless, for every account, the tokens are healthy and the last
+// successful fetch is recent.
+func (r *readiness) check() error {
+	// The token managers are checked without holding the lock, so a slow check of one doesn't
+	// block the updates of the others.
+	r.mu.Lock()
+	tokens := maps.Clone(r.tokens)
+	lastSuccess := maps.Clone(r.lastSuccess)
+	r.mu.Unlock()
+	if len(tokens) == 0 {
+		return fmt.Errorf("not initialized")
+	}
+	var errs []error
+	for _, account := range slices.Sorted(maps.Keys(tokens)) {
+		if err := r.checkAccount(tokens[account], lastSuccess[account]); err != nil {
+			if account != "" {
+				err = fmt.Errorf("account %s: %w", account, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *readiness) checkAccount(tokens *tokenManager, lastSuccess time.Time) error {
+	if err := tokens.healthy(); err != nil {
+		return err
+	}
+	if lastSuccess.IsZero() {
+		return fmt.Errorf("no successful fetch yet")
+	}
+	if age := time.Since(lastSuccess); r.maxAge > 0 && age > r.maxAge {
+		return fmt.Errorf("last successful fetch was %s ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+// startServer serves /metrics, /healthz, /readyz and, if enabled, /history on addr until shutdown
+// is called. histories maps the account names to their history store.
+func startServer(addr string, ready *readiness, histories map[string]*historyStore) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{Registry: metricsRegistry}))
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if err := ready.check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	if len(histories) > 0 {
+		mux.HandleFunc("GET /history", func(w http.ResponseWriter, r *http.Request) {
+			// The implicit account of a single account config has an empty name.
+			account := r.URL.Query().Get("account")
+			history, ok := histories[account]
+			if !ok {
+				http.Error(w, fmt.Sprintf("unknown account %q", account), http.StatusNotFound)
+				return
+			}
+			history.serveHTTP(w, r)
+		})
+	}
+
+	// Listen synchronously so a bad address fails at startup instead of in the background.
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("server: %v", err)
+		}
+	}()
+	log.Infof("server: listening on %s", ln.Addr())
+	return srv, nil
+}
+
+// shutdownServer gracefully stops the server, waiting a few seconds for in-flight scrapes.
+func shutdownServer(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warningf("server: failed to shut down: %v", err)
+	}
+}
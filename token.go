@@ -1,77 +1,264 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"net/url"
-	"strings"
+	"sync"
+	"time"
 
-	"github.com/hashicorp/go-retryablehttp"
+	"github.com/csobrinho/xfinity-usage/xfinity"
+	log "github.com/google/logger"
 	"golang.org/x/oauth2"
 )
 
-var (
-	tokenExtraHeaders = map[string]string{
-		"User-Agent": "Dalvik/2.1.0 (Linux; U; Android 14; SM-G991B Build/G991BXXUEGXJE",
+// errTokenRefresh wraps every failure to obtain an access token.
+var errTokenRefresh = errors.New("failed to access token")
+
+// tokenManager tracks the current OAuth tokens across runs. It is the token source of the API
+// client: a single reusable source per account refreshes the access token once it expires within
+// the margin, and every refresh is persisted to the token store and, whenever the refresh token
+// rotates, to the sinks.
+type tokenManager struct {
+	// account is the name of the account in the metrics.
+	account string
+	api     *xfinity.Client
+	store   tokenStore
+	sinks   []tokenSink
+	// accessToken and idToken are the provided tokens, used as is instead of refreshing when both
+	// are set. They are copied at creation so a reload of the config never races with their readers.
+	accessToken string
+	idToken     string
+	margin      time.Duration
+	// refresher refreshes the tokens, following the rotations of the refresh token.
+	refresher oauth2.TokenSource
+
+	// mu only guards the fields below and is never held across a refresh, so health checks never
+	// wait for one.
+	mu sync.Mutex
+	// src reuses the access token until it expires and refreshes it through refresher. It is
+	// replaced to drop a rejected access token.
+	src        oauth2.TokenSource
+	current    storedToken
+	refreshErr error // Error of the last refresh attempt, if it failed.
+}
+
+// newTokenManager loads the persisted tokens, if any. A stored refresh token takes precedence
+// over the configured one, since it is the most recently rotated one. The manager must be bound
+// to the API client, which refreshes the tokens and uses the manager as its token source, before
+// use.
+func newTokenManager(account, refreshToken, accessToken, idToken string, store tokenStore, sinks ...tokenSink) (*tokenManager, error) {
+	m := &tokenManager{
+		account:     account,
+		store:       store,
+		sinks:       sinks,
+		accessToken: accessToken,
+		idToken:     idToken,
+		current:     storedToken{RefreshToken: refreshToken},
 	}
-	tokenExtraValues = map[string]string{
-		"active_x1_account_count": "true",
-		"partner_id":              "comcast",
-		"mso_partner_hint":        "true",
-		"scope":                   "profile",
-		"rm_hint":                 "true",
+	if store == nil {
+		return m, nil
 	}
-)
+	t, err := store.load()
+	if err != nil {
+		recordError(errorCategoryTokenStore, m.account)
+		return nil, err
+	}
+	if t != nil && t.RefreshToken != "" {
+		log.Info("main: using refresh token from token store")
+		m.current = *t
+	}
+	return m, nil
+}
 
-type TokenExtra struct {
-	IDToken    string `json:"id_token"`
-	ActivityID string `json:"activity_id"`
+// bind sets the API client and creates the token source, which reuses the cached access token
+// while it is valid for at least margin. ctx is used by every refresh and by the persistence of
+// the refreshed tokens, so it must outlive the runs.
+func (m *tokenManager) bind(ctx context.Context, api *xfinity.Client, margin time.Duration) {
+	m.api, m.margin = api, margin
+	m.refresher = &persistingTokenSource{ctx: ctx, m: m, base: api.RefreshTokenSource(ctx, m.current.RefreshToken)}
+	var initial *oauth2.Token
+	if m.current.AccessToken != "" && m.current.IDToken != "" {
+		initial = &oauth2.Token{AccessToken: m.current.AccessToken, TokenType: "Bearer", RefreshToken: m.current.RefreshToken, Expiry: m.current.Expiry}
+		initial = xfinity.WithIDToken(initial, m.current.IDToken)
+	}
+	m.src = oauth2.ReuseTokenSourceWithExpiry(initial, m.refresher, margin)
 }
 
-func tokenRequest(ctx context.Context, client *retryablehttp.Client, refreshToken, clientID, clientSecret, applicationID string) (*oauth2.Token, *TokenExtra, error) {
-	data := url.Values{}
-	data.Set("grant_type", "refresh_token")
-	data.Set("refresh_token", refreshToken)
-	data.Set("client_id", clientID)
-	data.Set("client_secret", clientSecret)
-	if applicationID != "" {
-		data.Set("application_id", applicationID)
+// do calls fn, which makes API requests, once the tokens are valid. If a cached access token is
+// rejected with a 401, the tokens are refreshed and fn is retried once.
+func (m *tokenManager) do(fn func() error) error {
+	token, refreshed, err := m.token()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	if refreshed || !isUnauthorized(err) {
+		return err
 	}
 
-	for key, value := range tokenExtraValues {
-		data.Set(key, value)
+	log.Warning("main: cached access token was rejected, refreshing")
+	m.invalidate(token.AccessToken)
+	if _, _, err = m.token(); err != nil {
+		return err
 	}
-	req, err := retryablehttp.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(data.Encode()))
+	return fn()
+}
+
+// Token implements oauth2.TokenSource for the API client.
+func (m *tokenManager) Token() (*oauth2.Token, error) {
+	if m.provided() {
+		return xfinity.WithIDToken(&oauth2.Token{AccessToken: m.accessToken, TokenType: "Bearer"}, m.idToken), nil
+	}
+	m.mu.Lock()
+	src := m.src
+	m.mu.Unlock()
+	if src == nil {
+		return nil, fmt.Errorf("%w: no token source", errTokenRefresh)
+	}
+	return src.Token()
+}
+
+// token returns the tokens to use for the next requests and whether they were just refreshed, or
+// provided, instead of served from the cache.
+func (m *tokenManager) token() (*oauth2.Token, bool, error) {
+	if m.provided() {
+		log.Info("main: using provided access token")
+		t, err := m.Token()
+		return t, true, err
+	}
+	m.mu.Lock()
+	prev := m.current.AccessToken
+	m.mu.Unlock()
+	t, err := m.Token()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, false, err
+	}
+	refreshed := t.AccessToken != prev
+	if !refreshed {
+		log.Infof("main: using cached access token, expires in %s", time.Until(t.Expiry).Round(time.Second))
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	for key, value := range tokenExtraHeaders {
-		req.Header.Set(key, value)
+	return t, refreshed, nil
+}
+
+// refreshed records the tokens of a successful refresh and persists them. The run can still
+// succeed with the new tokens, so saving failures are only reported.
+func (m *tokenManager) refreshed(ctx context.Context, token *oauth2.Token) {
+	log.Infof("main: token expiry: %d seconds", token.ExpiresIn)
+	log.V(2).Infof("main: access token: %s", token.AccessToken)
+	log.V(2).Infof("main: id token:     %s", xfinity.IDToken(token))
+
+	next := storedToken{
+		RefreshToken: token.RefreshToken,
+		AccessToken:  token.AccessToken,
+		IDToken:      xfinity.IDToken(token),
+		Expiry:       token.Expiry,
 	}
-	resp, err := client.Do(req)
+	m.mu.Lock()
+	rotated := next.RefreshToken != m.current.RefreshToken
+	m.current, m.refreshErr = next, nil
+	m.mu.Unlock()
+	if rotated {
+		log.Info("main: refresh token was rotated")
+	}
+
+	if m.store != nil {
+		if err := m.store.save(ctx, &next); err != nil {
+			recordError(errorCategoryTokenStore, m.account)
+			log.Errorf("main: failed to save tokens: %v", err)
+		}
+	}
+	if rotated {
+		for _, sink := range m.sinks {
+			if err := sink.save(ctx, &next); err != nil {
+				recordError(errorCategoryTokenStore, m.account)
+				log.Errorf("main: failed to save rotated refresh token: %v", err)
+			}
+		}
+	}
+}
+
+// persistingTokenSource wraps the refreshes of a tokenManager to observe them: it records their
+// metrics and errors and persists the new tokens.
+type persistingTokenSource struct {
+	ctx  context.Context
+	m    *tokenManager
+	base oauth2.TokenSource
+}
+
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := s.base.Token()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to send request: %w", err)
+		recordError(errorCategoryTokenRefresh, s.m.account)
+		s.m.mu.Lock()
+		s.m.refreshErr = err
+		s.m.mu.Unlock()
+		return nil, fmt.Errorf("%w: %w", errTokenRefresh, err)
 	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
+	tokenRefreshDuration.Observe(time.Since(start).Seconds())
+	s.m.refreshed(s.ctx, token)
+	return token, nil
+}
+
+// provided reports whether the access and id tokens were provided instead of refreshed.
+func (m *tokenManager) provided() bool {
+	return m.accessToken != "" && m.idToken != ""
+}
 
-	// Check for HTTP errors
-	if resp.StatusCode != http.StatusOK {
-		return nil, nil, fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, body)
+// healthy returns an error if the manager can't currently provide tokens: the last refresh failed
+// or there is no refresh token to begin with.
+func (m *tokenManager) healthy() error {
+	if m.provided() {
+		return nil
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.refreshErr != nil {
+		return fmt.Errorf("%w: %w", errTokenRefresh, m.refreshErr)
+	}
+	if m.current.RefreshToken == "" {
+		return fmt.Errorf("%w: no refresh token available", errTokenRefresh)
+	}
+	return nil
+}
 
-	// Parse the token response
-	var raw struct {
-		oauth2.Token
-		TokenExtra
+// invalidate drops the cached access token so the next request refreshes it. It is a no-op if the
+// token has already been replaced by a concurrent refresh.
+func (m *tokenManager) invalidate(accessToken string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current.AccessToken == accessToken {
+		m.dropAccessToken()
 	}
-	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&raw); err != nil {
-		return nil, nil, fmt.Errorf("failed to parse token response: %w", err)
+}
+
+// refresh refreshes the tokens even if the cached access token is still valid.
+func (m *tokenManager) refresh() error {
+	m.mu.Lock()
+	m.dropAccessToken()
+	m.mu.Unlock()
+	_, _, err := m.token()
+	return err
+}
+
+// dropAccessToken replaces the token source with one that refreshes on its first use. The
+// refresher keeps following the rotated refresh token. m.mu must be held.
+func (m *tokenManager) dropAccessToken() {
+	m.current.AccessToken, m.current.IDToken, m.current.Expiry = "", "", time.Time{}
+	if m.refresher != nil {
+		m.src = oauth2.ReuseTokenSourceWithExpiry(nil, m.refresher, m.margin)
 	}
-	return &raw.Token, &raw.TokenExtra, nil
+}
+
+// state returns a copy of the current tokens.
+func (m *tokenManager) state() storedToken {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current
+}
+
+// persisted reports whether a rotated refresh token is saved anywhere.
+func (m *tokenManager) persisted() bool {
+	return m.store != nil || len(m.sinks) > 0
 }
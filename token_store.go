@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// storedToken is the OAuth token state persisted between runs.
+type storedToken struct {
+	RefreshToken string    `json:"refresh_token"`
+	AccessToken  string    `json:"access_token,omitempty"`
+	IDToken      string    `json:"id_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitzero"`
+}
+
+// tokenSink receives the latest tokens after a refresh.
+type tokenSink interface {
+	// save replaces the stored token.
+	save(ctx context.Context, t *storedToken) error
+}
+
+// tokenStore persists the latest tokens so a rotated refresh token survives restarts.
+type tokenStore interface {
+	tokenSink
+	// load returns the stored token, or nil if nothing has been stored yet.
+	load() (*storedToken, error)
+}
+
+// newTokenStore returns the token store for the given path, or nil if persistence is disabled.
+func newTokenStore(path string) tokenStore {
+	if path == "" {
+		return nil
+	}
+	return &fileTokenStore{path: path}
+}
+
+// fileTokenStore stores the token as JSON in a local file readable only by the owner.
+type fileTokenStore struct {
+	path string
+}
+
+func (s *fileTokenStore) load() (*storedToken, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token store: %w", err)
+	}
+	t := new(storedToken)
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("failed to parse token store %s: %w", s.path, err)
+	}
+	return t, nil
+}
+
+// save writes the token to a temporary file next to the target and renames it into place, so a
+// crash mid-write never leaves a truncated token behind.
+func (s *fileTokenStore) save(_ context.Context, t *storedToken) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal token: %w", err)
+	}
+	return writeFileAtomic(s.path, data, 0o600)
+}
+
+// writeFileAtomic writes data to path via a temporary file and a rename.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
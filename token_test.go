@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/csobrinho/xfinity-usage/xfinity"
+)
+
+// fakeXfinity issues a new access token, and rotates the refresh token, on every refresh and
+// rejects the API requests that don't use the latest access token, as well as the next reject
+// ones, e.g. after a revocation.
+type fakeXfinity struct {
+	refreshes int
+	calls     int
+	reject    int
+}
+
+func (f *fakeXfinity) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/token":
+		r.ParseForm()
+		if want := fmt.Sprintf("refresh-%d", f.refreshes); r.PostForm.Get("refresh_token") != want {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		f.refreshes++
+		fmt.Fprintf(w, `{"access_token":"access-%d","id_token":"id-%d","refresh_token":"refresh-%d","expires_in":3600}`,
+			f.refreshes, f.refreshes, f.refreshes)
+	case "/api":
+		f.calls++
+		want := fmt.Sprintf("access-%d", f.refreshes)
+		if f.reject > 0 || r.Header.Get("Authorization") != "Bearer "+want || r.Header.Get("x-id-token") != fmt.Sprintf("id-%d", f.refreshes) {
+			f.reject--
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}
+}
+
+func newTestTokenManager(t *testing.T, srv *httptest.Server, store tokenStore) (*tokenManager, *xfinity.Client) {
+	t.Helper()
+	tokens, err := newTokenManager("", "refresh-0", "", "", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := xfinity.New(
+		xfinity.WithHTTPClient(srv.Client()),
+		xfinity.WithTokenURL(srv.URL+"/token"),
+		xfinity.WithAPIURL(srv.URL+"/api"),
+		xfinity.WithTokenSource(tokens),
+	)
+	tokens.bind(context.Background(), api, time.Minute)
+	return tokens, api
+}
+
+func TestTokenManagerReusesAndPersistsTokens(t *testing.T) {
+	fake := &fakeXfinity{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	store := newTokenStore(filepath.Join(t.TempDir(), "token.json"))
+	tokens, api := newTestTokenManager(t, srv, store)
+
+	for range 3 {
+		if err := tokens.do(func() error { _, err := api.Query(context.Background(), []byte(`{}`)); return err }); err != nil {
+			t.Fatalf("do() = %v", err)
+		}
+	}
+	if fake.refreshes != 1 || fake.calls != 3 {
+		t.Errorf("got %d refreshes and %d calls, want 1 and 3", fake.refreshes, fake.calls)
+	}
+	saved, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.RefreshToken != "refresh-1" || saved.AccessToken != "access-1" || saved.IDToken != "id-1" {
+		t.Errorf("saved %+v, want the tokens of the refresh", saved)
+	}
+	if err := tokens.healthy(); err != nil {
+		t.Errorf("healthy() = %v", err)
+	}
+}
+
+func TestTokenManagerRefreshesRejectedToken(t *testing.T) {
+	fake := &fakeXfinity{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	tokens, api := newTestTokenManager(t, srv, nil)
+	query := func() error { _, err := api.Query(context.Background(), []byte(`{}`)); return err }
+
+	// A freshly refreshed token that is rejected isn't refreshed again.
+	fake.reject = 1
+	if err := tokens.do(query); !isUnauthorized(err) {
+		t.Fatalf("do() = %v, want a 401", err)
+	}
+	if fake.refreshes != 1 || fake.calls != 1 {
+		t.Fatalf("got %d refreshes and %d calls, want 1 and 1", fake.refreshes, fake.calls)
+	}
+
+	// A cached token that is rejected is refreshed, with the rotated refresh token, and retried.
+	fake.reject = 1
+	if err := tokens.do(query); err != nil {
+		t.Fatalf("do() = %v", err)
+	}
+	if fake.refreshes != 2 || fake.calls != 3 {
+		t.Errorf("got %d refreshes and %d calls, want 2 and 3", fake.refreshes, fake.calls)
+	}
+	if got := tokens.state().RefreshToken; got != "refresh-2" {
+		t.Errorf("refresh token = %q, want refresh-2", got)
+	}
+}
@@ -1,30 +1,13 @@
 package main
 
 import (
-	"bytes"
-	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"strings"
 	"time"
 
+	"github.com/csobrinho/xfinity-usage/xfinity"
 	log "github.com/google/logger"
-	"github.com/hashicorp/go-retryablehttp"
-)
-
-var (
-	usageExtraHeaders = map[string]string{
-		"x-apollo-operation-name": "InternetDataUsage",
-		"x-apollo-operation-id":   "61994c6016ac8c0ebcca875084919e5e01cb3b116a86aaf9646e597c3a1fbd06",
-		"accept":                  "multipart/mixed; deferSpec=20220824, application/json",
-		"user-agent":              "Digital Home / Samsung SM-G991B / Android 14",
-		"client":                  "digital-home-android",
-		"client-detail":           "MOBILE;Samsung;SM-G991B;Android 14;v5.38.0",
-		"accept-language":         "en-US",
-		"content-type":            "application/json",
-	}
 )
 
 const (
@@ -35,88 +18,8 @@ const (
 	attrIcon              = "mdi:wan"
 )
 
-type Usage struct {
-	Data *struct {
-		Account *struct {
-			Internet *struct {
-				Plan  *InternetPlan `json:"plan,omitempty"`
-				Usage *struct {
-					InPaidOverage *bool `json:"inPaidOverage,omitempty"`
-					Courtesy      *struct {
-						TotalAllowableCourtesy *int `json:"totalAllowableCourtesy,omitempty"`
-						UsedCourtesy           *int `json:"usedCourtesy,omitempty"`
-						RemainingCourtesy      *int `json:"remainingCourtesy,omitempty"`
-					} `json:"courtesy,omitempty"`
-					MonthlyUsage []UsageMonthly `json:"monthlyUsage,omitempty"`
-				} `json:"usage,omitempty"`
-			} `json:"internet,omitempty"`
-		} `json:"accountByServiceAccountId,omitempty"`
-	} `json:"data,omitempty"`
-}
-
-type InternetPlan struct {
-	Name          string      `json:"name,omitempty"`
-	DownloadSpeed *SpeedValue `json:"downloadSpeed,omitempty"`
-	UploadSpeed   *SpeedValue `json:"uploadSpeed,omitempty"`
-}
-
-const PolicyUnlimited = "unlimited"
-
-type UsageMonthly struct {
-	Policy               string     `json:"policy,omitempty"`
-	Month                *int       `json:"month,omitempty"`
-	Year                 *int       `json:"year,omitempty"`
-	StartDate            string     `json:"startDate,omitempty"`
-	EndDate              string     `json:"endDate,omitempty"`
-	DaysRemaining        *int       `json:"daysRemaining,omitempty"`
-	CurrentUsage         UsageValue `json:"currentUsage"`
-	AllowableUsage       UsageValue `json:"allowableUsage"`
-	Overage              bool       `json:"overage"`
-	OverageCharge        *int       `json:"overageCharge,omitempty"`
-	MaximumOverageCharge *int       `json:"maximumOverageCharge,omitempty"`
-	CourtesyCredit       bool       `json:"courtesyCredit"`
-}
-
-type UsageValue struct {
-	Value *float32 `json:"value,omitempty"`
-	Unit  string   `json:"unit,omitempty"`
-}
-
-func (u UsageValue) GB() (float32, error) {
-	if u.Value == nil {
-		return 0, fmt.Errorf("no usage value")
-	}
-	switch strings.ToLower(u.Unit) {
-	case "mb":
-		return *u.Value / 1000, nil
-	case "gb":
-		return *u.Value, nil
-	case "tb":
-		return *u.Value * 1000, nil
-	default:
-		return 0, fmt.Errorf("unknown usage %s unit", u.Unit)
-	}
-}
-
-type SpeedValue struct {
-	Value *float32 `json:"value,omitempty"`
-	Unit  string   `json:"unit,omitempty"`
-}
-
-func (u SpeedValue) Gbps() (float32, error) {
-	if u.Value == nil {
-		return 0, fmt.Errorf("no speed value")
-	}
-	switch strings.ToLower(u.Unit) {
-	case "mbps":
-		return *u.Value / 1000, nil
-	case "gbps":
-		return *u.Value, nil
-	default:
-		return 0, fmt.Errorf("unknown speed %s unit", u.Unit)
-	}
-}
-func (u *SpeedValue) SafeGbps() *float32 {
+// safeGbps returns the speed in Gbit/s, or nil if it is unknown.
+func safeGbps(u *xfinity.SpeedValue) *float32 {
 	if u == nil || u.Value == nil {
 		return nil
 	}
@@ -167,8 +70,8 @@ func valueIf[T any](cond bool, value T) *T {
 	return nil
 }
 
-// ToAttributes converts the Usage data to UsageAttributes for MQTT publishing.
-func (u *Usage) ToAttributes() (*UsageAttributes, error) {
+// newUsageAttributes converts the usage data to UsageAttributes for MQTT publishing.
+func newUsageAttributes(u *xfinity.Usage) (*UsageAttributes, error) {
 	// Validate usage data structure.
 	if u.Data == nil || u.Data.Account == nil || u.Data.Account.Internet == nil ||
 		u.Data.Account.Internet.Usage == nil || len(u.Data.Account.Internet.Usage.MonthlyUsage) == 0 {
@@ -204,7 +107,7 @@ func (u *Usage) ToAttributes() (*UsageAttributes, error) {
 
 	// Calculate estimated usage and daily average.
 	usageEstimated, usageDailyAverage := calculateEstimatedUsage(currentGB, monthlyUsage.StartDate, monthlyUsage.EndDate)
-	notUnlimited := monthlyUsage.Policy != PolicyUnlimited
+	notUnlimited := monthlyUsage.Policy != xfinity.PolicyUnlimited
 
 	attrs := &UsageAttributes{
 		FriendlyName:      attrFriendlyName,
@@ -233,13 +136,89 @@ func (u *Usage) ToAttributes() (*UsageAttributes, error) {
 	}
 	if plan != nil {
 		attrs.PlanName = plan.Name
-		attrs.PlanDownloadSpeed = plan.DownloadSpeed.SafeGbps()
-		attrs.PlanUploadSpeed = plan.UploadSpeed.SafeGbps()
+		attrs.PlanDownloadSpeed = safeGbps(plan.DownloadSpeed)
+		attrs.PlanUploadSpeed = safeGbps(plan.UploadSpeed)
 	}
 
 	return attrs, nil
 }
 
+// newUsageHistory converts every month returned by the API, most recent first, to UsageHistory.
+// Months whose usage can't be parsed are skipped.
+func newUsageHistory(u *xfinity.Usage) (*UsageHistory, error) {
+	months, err := monthlyUsage(u)
+	if err != nil {
+		return nil, err
+	}
+	history := &UsageHistory{Months: []UsageHistoryMonth{}}
+	for _, m := range months {
+		hm, err := newUsageHistoryMonth(m)
+		if err != nil {
+			log.Warningf("usage: skipping month: %v", err)
+			continue
+		}
+		history.Months = append(history.Months, hm)
+	}
+	return history, nil
+}
+
+// monthlyUsage returns every month returned by the API, most recent first.
+func monthlyUsage(u *xfinity.Usage) ([]xfinity.UsageMonthly, error) {
+	if u.Data == nil || u.Data.Account == nil || u.Data.Account.Internet == nil ||
+		u.Data.Account.Internet.Usage == nil || len(u.Data.Account.Internet.Usage.MonthlyUsage) == 0 {
+		return nil, fmt.Errorf("invalid usage data structure")
+	}
+	return u.Data.Account.Internet.Usage.MonthlyUsage, nil
+}
+
+// newUsageHistoryMonth converts a month returned by the API, failing if its date or usage can't be
+// parsed.
+func newUsageHistoryMonth(m xfinity.UsageMonthly) (UsageHistoryMonth, error) {
+	year, month, err := m.YearMonth()
+	if err != nil {
+		return UsageHistoryMonth{}, err
+	}
+	currentGB, err := m.CurrentUsage.GB()
+	if err != nil {
+		return UsageHistoryMonth{}, fmt.Errorf("%04d-%02d: %w", year, month, err)
+	}
+	hm := UsageHistoryMonth{
+		Year:           year,
+		Month:          month,
+		StartDate:      m.StartDate,
+		EndDate:        m.EndDate,
+		Policy:         m.Policy,
+		Usage:          currentGB,
+		Overage:        m.Overage,
+		OverageCharges: m.OverageCharge,
+	}
+	if m.Policy != xfinity.PolicyUnlimited {
+		if allowableGB, err := m.AllowableUsage.GB(); err == nil {
+			agb := int(allowableGB)
+			hm.AllowableUsage = &agb
+		}
+	}
+	return hm, nil
+}
+
+// UsageHistory represents every billing cycle returned by the API, published to MQTT.
+type UsageHistory struct {
+	Months []UsageHistoryMonth `json:"months"`
+}
+
+// UsageHistoryMonth is the usage of a single billing cycle.
+type UsageHistoryMonth struct {
+	Year           int     `json:"year"`
+	Month          int     `json:"month"`
+	StartDate      string  `json:"start_date"`
+	EndDate        string  `json:"end_date"`
+	Policy         string  `json:"policy"`
+	Usage          float32 `json:"usage"`
+	AllowableUsage *int    `json:"allowable_usage,omitempty"`
+	Overage        bool    `json:"overage"`
+	OverageCharges *int    `json:"overage_charges,omitempty"`
+}
+
 // UsageAttributes represents the usage data published to MQTT for Home Assistant.
 type UsageAttributes struct {
 	// Main Home Assistant attributes.
@@ -265,40 +244,57 @@ type UsageAttributes struct {
 	PlanName             string   `json:"plan_name,omitempty"`
 	PlanDownloadSpeed    *float32 `json:"plan_download_speed_gbps,omitempty"`
 	PlanUploadSpeed      *float32 `json:"plan_upload_speed_gbps,omitempty"`
+	AvailabilityTopic    string   `json:"availability_topic,omitempty"`
+
+	// Usage deltas, only available with a usage history.
+	UsageLastHour  *float32 `json:"usage_last_hour,omitempty"`
+	UsageToday     *float32 `json:"usage_today,omitempty"`
+	UsageYesterday *float32 `json:"usage_yesterday,omitempty"`
+	UsageLast7Days *float32 `json:"usage_last_7_days,omitempty"`
+
+	// Forecast of the end of cycle usage.
+	ForecastModel      string   `json:"forecast_model,omitempty"`
+	UsageEstimatedLow  *float32 `json:"usage_estimated_low,omitempty"`
+	UsageEstimatedHigh *float32 `json:"usage_estimated_high,omitempty"`
+	ProjectedCapDate   string   `json:"projected_cap_date,omitempty"`
+
+	// Overage cost, only available for plans with an allowance.
+	OverageProjectedCost *int  `json:"overage_projected_cost,omitempty"`
+	OverageNextBlockCost *int  `json:"overage_next_block_cost,omitempty"`
+	OverageNextBlockAt   *int  `json:"overage_next_block_at,omitempty"`
+	OverageWaived        *bool `json:"overage_waived,omitempty"`
 }
 
-func query(ctx context.Context, client *retryablehttp.Client, accessToken, idToken, url, method string, requestBody io.Reader, headers map[string]string) ([]byte, error) {
-	req, err := retryablehttp.NewRequestWithContext(ctx, method, url, requestBody)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("authorization", "Bearer "+accessToken)
-	req.Header.Set("x-id-token", idToken)
-	for key, value := range headers {
-		req.Header.Set(key, value)
-	}
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
-	}
-	defer res.Body.Close()
-	body, _ := io.ReadAll(res.Body)
+// setOverageCost sets the overage cost attributes.
+func (a *UsageAttributes) setOverageCost(c overageCost) {
+	a.OverageProjectedCost = &c.Projected
+	a.OverageNextBlockCost = &c.NextBlock
+	a.OverageNextBlockAt = &c.NextBlockAt
+	a.OverageWaived = &c.Waived
+}
 
-	// Check for HTTP errors
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed with request status %d: %s", res.StatusCode, body)
+// setForecast replaces the linear estimate with the forecast and its confidence band.
+func (a *UsageAttributes) setForecast(f usageForecast) {
+	a.ForecastModel = string(f.Model)
+	a.UsageEstimated = f.Estimated
+	a.UsageEstimatedLow = &f.Low
+	a.UsageEstimatedHigh = &f.High
+	a.ProjectedCapDate = ""
+	if f.CapDate != nil && a.AllowableUsage != nil {
+		a.ProjectedCapDate = f.CapDate.Format("2006-01-02")
 	}
-	return body, nil
 }
 
-func internetDataUsageRequest(ctx context.Context, client *retryablehttp.Client, accessToken, idToken string) (*Usage, error) {
-	body, err := query(ctx, client, accessToken, idToken, usageURL, "POST", strings.NewReader(usageBody), usageExtraHeaders)
-	if err != nil {
-		return nil, err
-	}
-	u := new(Usage)
-	if err := json.NewDecoder(bytes.NewReader(body)).Decode(u); err != nil {
-		return nil, fmt.Errorf("failed to parse usage response: %w", err)
-	}
-	return u, nil
+// setDeltas sets the usage delta attributes.
+func (a *UsageAttributes) setDeltas(d usageDeltas) {
+	a.UsageLastHour = &d.LastHour
+	a.UsageToday = &d.Today
+	a.UsageYesterday = &d.Yesterday
+	a.UsageLast7Days = &d.Last7Days
+}
+
+// isUnauthorized reports whether err was caused by the server rejecting the access token.
+func isUnauthorized(err error) bool {
+	var se *xfinity.StatusError
+	return errors.As(err, &se) && se.StatusCode == http.StatusUnauthorized
 }
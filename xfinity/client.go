@@ -0,0 +1,177 @@
+// Package xfinity is a client for the Xfinity mobile app API, which reports the internet data
+// usage of an account.
+package xfinity
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// DefaultTokenURL is the OAuth token endpoint used by the mobile app.
+	DefaultTokenURL = "https://xerxes-sub.xerxessecure.com/xerxes-ctrl/oauth/token"
+	// DefaultAPIURL is the GraphQL endpoint used by the mobile app.
+	DefaultAPIURL = "https://gw.api.dh.comcast.com/galileo/graphql"
+	// DefaultClientID is the OAuth client id of the Android app.
+	DefaultClientID = "xfinity-android-application"
+)
+
+const internetDataUsageQuery = `{"operationName":"InternetDataUsage","variables":{},"query":"query InternetDataUsage { accountByServiceAccountId { internet { plan { name downloadSpeed { unit value } uploadSpeed { unit value } } usage { inPaidOverage courtesy { totalAllowableCourtesy usedCourtesy remainingCourtesy } monthlyUsage { policy month year startDate endDate daysRemaining currentUsage { value unit } allowableUsage { value unit } overage overageCharge maximumOverageCharge courtesyCredit } } } } }"}`
+
+// HeaderProfile holds the app specific headers and values sent with the requests, which the API
+// uses to identify the app.
+type HeaderProfile struct {
+	// Token holds the headers of token requests.
+	Token map[string]string
+	// TokenValues holds the extra form values of token requests.
+	TokenValues map[string]string
+	// API holds the headers of GraphQL requests.
+	API map[string]string
+}
+
+// AndroidProfile identifies the requests as coming from the Android app.
+var AndroidProfile = HeaderProfile{
+	Token: map[string]string{
+		"User-Agent": "Dalvik/2.1.0 (Linux; U; Android 14; SM-G991B Build/G991BXXUEGXJE",
+	},
+	TokenValues: map[string]string{
+		"active_x1_account_count": "true",
+		"partner_id":              "comcast",
+		"mso_partner_hint":        "true",
+		"scope":                   "profile",
+		"rm_hint":                 "true",
+	},
+	API: map[string]string{
+		"x-apollo-operation-name": "InternetDataUsage",
+		"x-apollo-operation-id":   "61994c6016ac8c0ebcca875084919e5e01cb3b116a86aaf9646e597c3a1fbd06",
+		"accept":                  "multipart/mixed; deferSpec=20220824, application/json",
+		"user-agent":              "Digital Home / Samsung SM-G991B / Android 14",
+		"client":                  "digital-home-android",
+		"client-detail":           "MOBILE;Samsung;SM-G991B;Android 14;v5.38.0",
+		"accept-language":         "en-US",
+		"content-type":            "application/json",
+	},
+}
+
+// Client calls the Xfinity API. It is safe for concurrent use if its token source is.
+type Client struct {
+	httpClient    *http.Client
+	tokenURL      string
+	apiURL        string
+	clientID      string
+	clientSecret  string
+	applicationID string
+	tokens        oauth2.TokenSource
+	headers       HeaderProfile
+
+	// api sends the GraphQL requests through an authenticated Transport.
+	api *http.Client
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client of the requests, http.DefaultClient by default.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cl *Client) { cl.httpClient = c }
+}
+
+// WithTokenURL overrides DefaultTokenURL.
+func WithTokenURL(u string) Option {
+	return func(c *Client) { c.tokenURL = u }
+}
+
+// WithAPIURL overrides DefaultAPIURL.
+func WithAPIURL(u string) Option {
+	return func(c *Client) { c.apiURL = u }
+}
+
+// WithClientCredentials sets the OAuth client used to refresh tokens. The client id defaults to
+// DefaultClientID.
+func WithClientCredentials(clientID, clientSecret string) Option {
+	return func(c *Client) { c.clientID, c.clientSecret = clientID, clientSecret }
+}
+
+// WithApplicationID sets the optional OAuth application id sent when refreshing tokens.
+func WithApplicationID(id string) Option {
+	return func(c *Client) { c.applicationID = id }
+}
+
+// WithTokenSource sets the source of the tokens of API requests, e.g. Client.TokenSource. The
+// tokens must carry the id token, see IDToken.
+func WithTokenSource(ts oauth2.TokenSource) Option {
+	return func(c *Client) { c.tokens = ts }
+}
+
+// WithHeaderProfile overrides AndroidProfile.
+func WithHeaderProfile(p HeaderProfile) Option {
+	return func(c *Client) { c.headers = p }
+}
+
+// New returns a client with the given options.
+func New(opts ...Option) *Client {
+	c := &Client{
+		httpClient: http.DefaultClient,
+		tokenURL:   DefaultTokenURL,
+		apiURL:     DefaultAPIURL,
+		clientID:   DefaultClientID,
+		headers:    AndroidProfile,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	api := *c.httpClient
+	api.Transport = &Transport{Source: c.tokens, Header: c.headers.API, Base: c.httpClient.Transport}
+	c.api = &api
+	return c
+}
+
+// Query sends a GraphQL request body, e.g. {"query": "..."}, and returns the response body. A
+// non-200 response returns a *StatusError.
+func (c *Client) Query(ctx context.Context, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.apiURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	res, err := c.api.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+	respBody, _ := io.ReadAll(res.Body)
+
+	// Check for HTTP errors
+	if res.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: res.StatusCode, Body: respBody}
+	}
+	return respBody, nil
+}
+
+// InternetDataUsage returns the internet plan and the usage of the recent billing cycles.
+func (c *Client) InternetDataUsage(ctx context.Context) (*Usage, error) {
+	body, err := c.Query(ctx, []byte(internetDataUsageQuery))
+	if err != nil {
+		return nil, err
+	}
+	u := new(Usage)
+	if err := json.Unmarshal(body, u); err != nil {
+		return nil, fmt.Errorf("failed to parse usage response: %w", err)
+	}
+	return u, nil
+}
+
+// StatusError is returned when the server responds with a non-200 status.
+type StatusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("failed with request status %d: %s", e.StatusCode, e.Body)
+}
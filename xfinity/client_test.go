@@ -0,0 +1,94 @@
+package xfinity
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestClientQuery(t *testing.T) {
+	var gotPath, gotAuth, gotIDToken, gotClient string
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotAuth, gotIDToken, gotClient = r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("x-id-token"), r.Header.Get("client")
+		gotBody, _ = io.ReadAll(r.Body)
+		w.Write([]byte(`{"data":{}}`))
+	}))
+	defer srv.Close()
+	c := newTestClient(srv,
+		WithTokenSource(oauth2.StaticTokenSource(WithIDToken(&oauth2.Token{AccessToken: "access", TokenType: "Bearer"}, "id"))),
+		WithHeaderProfile(HeaderProfile{API: map[string]string{"client": "test"}}),
+	)
+
+	body, err := c.Query(context.Background(), []byte(`{"query":"{ a }"}`))
+	if err != nil {
+		t.Fatalf("Query() = %v", err)
+	}
+	if string(body) != `{"data":{}}` {
+		t.Errorf("Query() = %s, want the response body", body)
+	}
+	if gotPath != "/api" || string(gotBody) != `{"query":"{ a }"}` {
+		t.Errorf("sent %s to %s, want the query to /api", gotBody, gotPath)
+	}
+	if gotAuth != "Bearer access" || gotIDToken != "id" || gotClient != "test" {
+		t.Errorf("headers = %q, %q and %q, want the tokens and the profile headers", gotAuth, gotIDToken, gotClient)
+	}
+}
+
+func TestClientDefaults(t *testing.T) {
+	c := New()
+	if c.httpClient != http.DefaultClient || c.tokenURL != DefaultTokenURL || c.apiURL != DefaultAPIURL ||
+		c.clientID != DefaultClientID || c.headers.API["client"] != AndroidProfile.API["client"] {
+		t.Errorf("New() = %+v, want the defaults", c)
+	}
+	// The API requests must not change the transport of the shared client.
+	if http.DefaultClient.Transport != nil {
+		t.Errorf("default client transport = %T, want it unchanged", http.DefaultClient.Transport)
+	}
+}
+
+func TestClientStatusError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"expired"}`))
+	}))
+	defer srv.Close()
+	c := newTestClient(srv, WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "access"})))
+
+	_, err := c.InternetDataUsage(context.Background())
+	var se *StatusError
+	if !errors.As(err, &se) {
+		t.Fatalf("InternetDataUsage() = %v, want a *StatusError", err)
+	}
+	if se.StatusCode != http.StatusUnauthorized || string(se.Body) != `{"error":"expired"}` {
+		t.Errorf("status error = %d %s, want 401 with the response body", se.StatusCode, se.Body)
+	}
+}
+
+func TestClientInternetDataUsage(t *testing.T) {
+	var gotOperation string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotOperation = r.Header.Get("x-apollo-operation-name")
+		w.Write([]byte(`{"data":{"accountByServiceAccountId":{"internet":{"usage":{"monthlyUsage":[
+			{"policy":"limited","currentUsage":{"value":100,"unit":"GB"}}
+		]}}}}}`))
+	}))
+	defer srv.Close()
+	c := newTestClient(srv, WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "access"})))
+
+	u, err := c.InternetDataUsage(context.Background())
+	if err != nil {
+		t.Fatalf("InternetDataUsage() = %v", err)
+	}
+	if gotOperation != "InternetDataUsage" {
+		t.Errorf("operation = %q, want InternetDataUsage", gotOperation)
+	}
+	if gb, err := u.Data.Account.Internet.Usage.MonthlyUsage[0].CurrentUsage.GB(); err != nil || gb != 100 {
+		t.Errorf("current usage = %v, %v, want 100 GB", gb, err)
+	}
+}
@@ -0,0 +1,125 @@
+package xfinity
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// idTokenKey is the oauth2.Token extra holding the id token.
+const idTokenKey = "id_token"
+
+// IDToken returns the id token carried by t, which API requests require along with the access
+// token.
+func IDToken(t *oauth2.Token) string {
+	s, _ := t.Extra(idTokenKey).(string)
+	return s
+}
+
+// WithIDToken returns a copy of t carrying the id token.
+func WithIDToken(t *oauth2.Token, idToken string) *oauth2.Token {
+	return t.WithExtra(map[string]any{idTokenKey: idToken})
+}
+
+// RefreshToken exchanges a refresh token for new tokens. The id token and the other fields of the
+// response are kept in the token extras, see IDToken. The response may rotate the refresh token,
+// in which case the returned token carries the new one.
+func (c *Client) RefreshToken(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", refreshToken)
+	data.Set("client_id", c.clientID)
+	data.Set("client_secret", c.clientSecret)
+	if c.applicationID != "" {
+		data.Set("application_id", c.applicationID)
+	}
+
+	for key, value := range c.headers.TokenValues {
+		data.Set(key, value)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for key, value := range c.headers.Token {
+		req.Header.Set(key, value)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	// Check for HTTP errors
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token request %w", &StatusError{StatusCode: resp.StatusCode, Body: body})
+	}
+
+	// Parse the token response
+	t := new(oauth2.Token)
+	if err := json.Unmarshal(body, t); err != nil {
+		return nil, fmt.Errorf("failed to parse token response: %w", err)
+	}
+	var extra map[string]any
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&extra); err != nil {
+		return nil, fmt.Errorf("failed to parse token response: %w", err)
+	}
+	if t.AccessToken == "" {
+		return nil, errors.New("token response has no access token")
+	}
+	if t.Expiry.IsZero() && t.ExpiresIn > 0 {
+		t.Expiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
+	return t.WithExtra(extra), nil
+}
+
+// TokenSource returns a token source that reuses t until it expires and then refreshes it with
+// its refresh token, like oauth2.Config.TokenSource. ctx is used by the refreshes, and the source
+// is safe for concurrent use.
+func (c *Client) TokenSource(ctx context.Context, t *oauth2.Token) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(t, c.RefreshTokenSource(ctx, t.RefreshToken))
+}
+
+// RefreshTokenSource returns a token source that refreshes the tokens on every call, following
+// the rotations of the refresh token. It is meant to be wrapped by oauth2.ReuseTokenSource, e.g.
+// with a custom expiry margin.
+func (c *Client) RefreshTokenSource(ctx context.Context, refreshToken string) oauth2.TokenSource {
+	return &refreshTokenSource{ctx: ctx, client: c, refreshToken: refreshToken}
+}
+
+type refreshTokenSource struct {
+	ctx    context.Context
+	client *Client
+
+	mu           sync.Mutex
+	refreshToken string
+}
+
+func (s *refreshTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refreshToken == "" {
+		return nil, errors.New("no refresh token available")
+	}
+	t, err := s.client.RefreshToken(s.ctx, s.refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if t.RefreshToken == "" {
+		t.RefreshToken = s.refreshToken
+	}
+	s.refreshToken = t.RefreshToken
+	return t, nil
+}
@@ -0,0 +1,169 @@
+package xfinity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenServer is a token endpoint that records the last request and replies with a new access
+// token, rotating the refresh token unless keep is set.
+type tokenServer struct {
+	form      url.Values
+	header    http.Header
+	refreshes int
+	keep      bool
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	s.form, s.header = r.PostForm, r.Header
+	s.refreshes++
+	if s.keep {
+		fmt.Fprintf(w, `{"access_token":"access-%d","id_token":"id-%d","token_type":"Bearer","expires_in":3600}`, s.refreshes, s.refreshes)
+		return
+	}
+	fmt.Fprintf(w, `{"access_token":"access-%d","id_token":"id-%d","refresh_token":"refresh-%d","token_type":"Bearer","expires_in":3600,"scope":"profile"}`,
+		s.refreshes, s.refreshes, s.refreshes)
+}
+
+func newTestClient(srv *httptest.Server, opts ...Option) *Client {
+	return New(append([]Option{WithHTTPClient(srv.Client()), WithTokenURL(srv.URL + "/token"), WithAPIURL(srv.URL + "/api")}, opts...)...)
+}
+
+func TestRefreshToken(t *testing.T) {
+	ts := &tokenServer{}
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+	profile := HeaderProfile{Token: map[string]string{"User-Agent": "test-agent"}, TokenValues: map[string]string{"scope": "profile"}}
+	c := newTestClient(srv, WithClientCredentials("client", "secret"), WithApplicationID("app"), WithHeaderProfile(profile))
+
+	start := time.Now()
+	token, err := c.RefreshToken(context.Background(), "refresh-0")
+	if err != nil {
+		t.Fatalf("RefreshToken() = %v", err)
+	}
+	want := url.Values{
+		"grant_type":     {"refresh_token"},
+		"refresh_token":  {"refresh-0"},
+		"client_id":      {"client"},
+		"client_secret":  {"secret"},
+		"application_id": {"app"},
+		"scope":          {"profile"},
+	}
+	if ts.form.Encode() != want.Encode() {
+		t.Errorf("form = %s, want %s", ts.form.Encode(), want.Encode())
+	}
+	if got := ts.header.Get("Content-Type"); got != "application/x-www-form-urlencoded" {
+		t.Errorf("content type = %q, want a form", got)
+	}
+	if got := ts.header.Get("User-Agent"); got != "test-agent" {
+		t.Errorf("user agent = %q, want the profile's", got)
+	}
+	if token.AccessToken != "access-1" || token.RefreshToken != "refresh-1" || IDToken(token) != "id-1" || token.Extra("scope") != "profile" {
+		t.Errorf("token = %+v with id token %q, want the tokens of the response", token, IDToken(token))
+	}
+	if token.Expiry.Before(start.Add(time.Hour)) || token.Expiry.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expiry = %v, want in an hour", token.Expiry)
+	}
+}
+
+func TestRefreshTokenErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantStatus int
+	}{
+		{name: "rejected", status: http.StatusBadRequest, body: `{"error":"invalid_grant"}`, wantStatus: http.StatusBadRequest},
+		{name: "no access token", status: http.StatusOK, body: `{"id_token":"id"}`},
+		{name: "invalid json", status: http.StatusOK, body: `{`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			_, err := newTestClient(srv).RefreshToken(context.Background(), "refresh")
+			if err == nil {
+				t.Fatal("RefreshToken() = nil, want an error")
+			}
+			var se *StatusError
+			if got := errors.As(err, &se); got != (tt.wantStatus != 0) {
+				t.Fatalf("RefreshToken() = %v, want a status error: %t", err, tt.wantStatus != 0)
+			}
+			if se != nil && (se.StatusCode != tt.wantStatus || string(se.Body) != tt.body) {
+				t.Errorf("status error = %d %s, want %d %s", se.StatusCode, se.Body, tt.wantStatus, tt.body)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenSource(t *testing.T) {
+	ts := &tokenServer{}
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+	src := newTestClient(srv).RefreshTokenSource(context.Background(), "refresh-0")
+
+	steps := []struct {
+		name string
+		// keep is whether the server doesn't rotate the refresh token.
+		keep        bool
+		wantSent    string
+		wantRefresh string
+	}{
+		{name: "rotated", wantSent: "refresh-0", wantRefresh: "refresh-1"},
+		{name: "follows the rotation", wantSent: "refresh-1", wantRefresh: "refresh-2"},
+		{name: "not rotated", keep: true, wantSent: "refresh-2", wantRefresh: "refresh-2"},
+		{name: "kept", wantSent: "refresh-2", wantRefresh: "refresh-4"},
+	}
+	for i, step := range steps {
+		ts.keep = step.keep
+		token, err := src.Token()
+		if err != nil {
+			t.Fatalf("%s: Token() = %v", step.name, err)
+		}
+		if got := ts.form.Get("refresh_token"); got != step.wantSent {
+			t.Errorf("%s: sent %q, want %q", step.name, got, step.wantSent)
+		}
+		if want := fmt.Sprintf("access-%d", i+1); token.AccessToken != want || IDToken(token) != fmt.Sprintf("id-%d", i+1) {
+			t.Errorf("%s: got %q and id token %q, want %q", step.name, token.AccessToken, IDToken(token), want)
+		}
+		if token.RefreshToken != step.wantRefresh {
+			t.Errorf("%s: refresh token = %q, want %q", step.name, token.RefreshToken, step.wantRefresh)
+		}
+	}
+
+	if _, err := newTestClient(srv).RefreshTokenSource(context.Background(), "").Token(); err == nil {
+		t.Error("Token() without a refresh token = nil, want an error")
+	}
+}
+
+func TestTokenSource(t *testing.T) {
+	ts := &tokenServer{}
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+	c := newTestClient(srv)
+
+	valid := WithIDToken(&oauth2.Token{AccessToken: "cached", RefreshToken: "refresh-0", Expiry: time.Now().Add(time.Hour)}, "cached-id")
+	token, err := c.TokenSource(context.Background(), valid).Token()
+	if err != nil || token.AccessToken != "cached" || IDToken(token) != "cached-id" || ts.refreshes != 0 {
+		t.Errorf("Token() = %+v, %v after %d refreshes, want the cached token", token, err, ts.refreshes)
+	}
+
+	expired := &oauth2.Token{AccessToken: "cached", RefreshToken: "refresh-0", Expiry: time.Now().Add(-time.Minute)}
+	token, err = c.TokenSource(context.Background(), expired).Token()
+	if err != nil || token.AccessToken != "access-1" || IDToken(token) != "id-1" || ts.form.Get("refresh_token") != "refresh-0" {
+		t.Errorf("Token() = %+v, %v, want a refreshed token", token, err)
+	}
+}
@@ -0,0 +1,52 @@
+package xfinity
+
+import (
+	"errors"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// Transport is an http.RoundTripper that authenticates the requests with the access and id tokens
+// of Source and adds the Header values, e.g. HeaderProfile.API.
+type Transport struct {
+	Source oauth2.TokenSource
+	Header map[string]string
+	// Base is the underlying transport, http.DefaultTransport if nil.
+	Base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The body must be closed even if the request is never sent.
+	closeBody := func() {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+	}
+	if t.Source == nil {
+		closeBody()
+		return nil, errors.New("no token source")
+	}
+	token, err := t.Source.Token()
+	if err != nil {
+		closeBody()
+		return nil, err
+	}
+
+	// RoundTrippers must not modify the original request.
+	r := req.Clone(req.Context())
+	for key, value := range t.Header {
+		r.Header.Set(key, value)
+	}
+	token.SetAuthHeader(r)
+	r.Header.Set("x-id-token", IDToken(token))
+	return t.base().RoundTrip(r)
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
@@ -0,0 +1,97 @@
+package xfinity
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) {
+	return f()
+}
+
+// closeRecorder records whether the request body was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestTransport(t *testing.T) {
+	var got *http.Request
+	tr := &Transport{
+		Source: oauth2.StaticTokenSource(WithIDToken(&oauth2.Token{AccessToken: "access", TokenType: "Bearer"}, "id")),
+		Header: map[string]string{"client": "test", "Accept": "application/json"},
+		Base: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			got = r
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/api", strings.NewReader("{}"))
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("X-Request", "kept")
+
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip() = %v", err)
+	}
+	for key, want := range map[string]string{
+		"Authorization": "Bearer access",
+		"x-id-token":    "id",
+		"client":        "test",
+		"Accept":        "application/json",
+		"X-Request":     "kept",
+	} {
+		if v := got.Header.Get(key); v != want {
+			t.Errorf("%s = %q, want %q", key, v, want)
+		}
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Accept") != "text/plain" {
+		t.Errorf("original request headers = %v, want them unchanged", req.Header)
+	}
+}
+
+func TestTransportErrors(t *testing.T) {
+	errSource := errors.New("no tokens")
+	tests := []struct {
+		name   string
+		source oauth2.TokenSource
+	}{
+		{name: "no source"},
+		{name: "source error", source: tokenSourceFunc(func() (*oauth2.Token, error) { return nil, errSource })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := false
+			tr := &Transport{Source: tt.source, Base: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				sent = true
+				return nil, nil
+			})}
+			body := &closeRecorder{Reader: strings.NewReader("{}")}
+			req, _ := http.NewRequest(http.MethodPost, "http://example.com/api", body)
+
+			_, err := tr.RoundTrip(req)
+			if err == nil || (tt.source != nil && !errors.Is(err, errSource)) {
+				t.Errorf("RoundTrip() = %v, want the source error", err)
+			}
+			if sent || !body.closed {
+				t.Errorf("sent = %t and body closed = %t, want the request dropped and its body closed", sent, body.closed)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package xfinity
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Usage is the response of the InternetDataUsage query.
+type Usage struct {
+	Data *struct {
+		Account *struct {
+			Internet *struct {
+				Plan  *InternetPlan `json:"plan,omitempty"`
+				Usage *struct {
+					InPaidOverage *bool `json:"inPaidOverage,omitempty"`
+					Courtesy      *struct {
+						TotalAllowableCourtesy *int `json:"totalAllowableCourtesy,omitempty"`
+						UsedCourtesy           *int `json:"usedCourtesy,omitempty"`
+						RemainingCourtesy      *int `json:"remainingCourtesy,omitempty"`
+					} `json:"courtesy,omitempty"`
+					MonthlyUsage []UsageMonthly `json:"monthlyUsage,omitempty"`
+				} `json:"usage,omitempty"`
+			} `json:"internet,omitempty"`
+		} `json:"accountByServiceAccountId,omitempty"`
+	} `json:"data,omitempty"`
+}
+
+// InternetPlan is the internet plan of the account.
+type InternetPlan struct {
+	Name          string      `json:"name,omitempty"`
+	DownloadSpeed *SpeedValue `json:"downloadSpeed,omitempty"`
+	UploadSpeed   *SpeedValue `json:"uploadSpeed,omitempty"`
+}
+
+// PolicyUnlimited is the policy of plans without an allowance.
+const PolicyUnlimited = "unlimited"
+
+// UsageMonthly is the usage of a billing cycle.
+type UsageMonthly struct {
+	Policy               string     `json:"policy,omitempty"`
+	Month                *int       `json:"month,omitempty"`
+	Year                 *int       `json:"year,omitempty"`
+	StartDate            string     `json:"startDate,omitempty"`
+	EndDate              string     `json:"endDate,omitempty"`
+	DaysRemaining        *int       `json:"daysRemaining,omitempty"`
+	CurrentUsage         UsageValue `json:"currentUsage"`
+	AllowableUsage       UsageValue `json:"allowableUsage"`
+	Overage              bool       `json:"overage"`
+	OverageCharge        *int       `json:"overageCharge,omitempty"`
+	MaximumOverageCharge *int       `json:"maximumOverageCharge,omitempty"`
+	CourtesyCredit       bool       `json:"courtesyCredit"`
+}
+
+// UsageValue is an amount of data.
+type UsageValue struct {
+	Value *float32 `json:"value,omitempty"`
+	Unit  string   `json:"unit,omitempty"`
+}
+
+// GB converts the value to GB.
+func (u UsageValue) GB() (float32, error) {
+	if u.Value == nil {
+		return 0, fmt.Errorf("no usage value")
+	}
+	switch strings.ToLower(u.Unit) {
+	case "mb":
+		return *u.Value / 1000, nil
+	case "gb":
+		return *u.Value, nil
+	case "tb":
+		return *u.Value * 1000, nil
+	default:
+		return 0, fmt.Errorf("unknown usage %s unit", u.Unit)
+	}
+}
+
+// SpeedValue is a connection speed.
+type SpeedValue struct {
+	Value *float32 `json:"value,omitempty"`
+	Unit  string   `json:"unit,omitempty"`
+}
+
+// Gbps converts the value to Gbit/s.
+func (u SpeedValue) Gbps() (float32, error) {
+	if u.Value == nil {
+		return 0, fmt.Errorf("no speed value")
+	}
+	switch strings.ToLower(u.Unit) {
+	case "mbps":
+		return *u.Value / 1000, nil
+	case "gbps":
+		return *u.Value, nil
+	default:
+		return 0, fmt.Errorf("unknown speed %s unit", u.Unit)
+	}
+}
+
+// YearMonth returns the billing month, falling back to the start date if the API omitted it.
+func (m UsageMonthly) YearMonth() (int, int, error) {
+	if m.Year != nil && m.Month != nil {
+		return *m.Year, *m.Month, nil
+	}
+	start, err := time.Parse("2006-01-02", m.StartDate)
+	if err != nil {
+		return 0, 0, fmt.Errorf("no year/month and invalid start_date %q: %w", m.StartDate, err)
+	}
+	return start.Year(), int(start.Month()), nil
+}